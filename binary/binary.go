@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"time"
 )
 
+var ErrShortBuffer = errors.New("buffer is too short to decode")
+
 type SimpleBinary struct {
 	cap    int
 	idx    int
@@ -35,6 +38,19 @@ func (s *SimpleBinary) EncodeBytes(val []byte) error {
 	return nil
 }
 
+// EncodeRaw copies val as is, without its length
+func (s *SimpleBinary) EncodeRaw(val []byte) error {
+	l := len(val)
+	if (s.idx + l) > s.cap {
+		return fmt.Errorf("buffer is small")
+	}
+
+	copy(s.buffer[s.idx:s.idx+l], val)
+	s.idx += l
+
+	return nil
+}
+
 func (s *SimpleBinary) EncodeUint64(val uint64) error {
 	if (s.idx + 8) > s.cap {
 		return fmt.Errorf("buffer is too small")
@@ -74,12 +90,31 @@ func (s *SimpleBinary) DecodeBytes() ([]byte, error) {
 		return nil, err
 	}
 
+	if l > uint64(s.Remaining()) {
+		return nil, ErrShortBuffer
+	}
+
 	b := s.buffer[s.idx : s.idx+int(l)]
 	s.idx += int(l)
 	return b, nil
 }
 
+// DecodeRaw returns the next l bytes which are encoded by EncodeRaw
+func (s *SimpleBinary) DecodeRaw(l int) ([]byte, error) {
+	if l > s.Remaining() {
+		return nil, ErrShortBuffer
+	}
+
+	b := s.buffer[s.idx : s.idx+l]
+	s.idx += l
+	return b, nil
+}
+
 func (s *SimpleBinary) DecodeUint64() (uint64, error) {
+	if s.Remaining() < 8 {
+		return 0, ErrShortBuffer
+	}
+
 	val, n := binary.Uvarint(s.buffer[s.idx : s.idx+8])
 	if n <= 0 {
 		return 0, fmt.Errorf("can't decode uint64. code: %d", n)
@@ -95,6 +130,10 @@ func (s *SimpleBinary) DecodeString() (string, error) {
 		return "", err
 	}
 
+	if l > uint64(s.Remaining()) {
+		return "", ErrShortBuffer
+	}
+
 	val := s.buffer[s.idx : s.idx+int(l)]
 	s.idx += int(l)
 
@@ -111,6 +150,11 @@ func (s *SimpleBinary) DecodeTime() (time.Time, error) {
 	return time.Parse(time.RFC3339Nano, encoded)
 }
 
+// Remaining returns the number of bytes which have not been encoded or decoded yet
+func (s *SimpleBinary) Remaining() int {
+	return s.cap - s.idx
+}
+
 func (s *SimpleBinary) Bytes() []byte {
 	return s.buffer[0:s.idx]
 }
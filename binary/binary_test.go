@@ -73,3 +73,37 @@ func TestEncodingDecoding(t *testing.T) {
 		t.Fatalf("expected to decode bytes currently")
 	}
 }
+
+func TestDecodingShortBuffer(t *testing.T) {
+	enc := binary.NewEncoding(100)
+
+	err := enc.EncodeString("Hello World")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encodedData := enc.Bytes()
+
+	dec := binary.NewDecoding(encodedData[:len(encodedData)-1])
+
+	_, err = dec.DecodeString()
+	if err != binary.ErrShortBuffer {
+		t.Fatalf("expected %s but got %v", binary.ErrShortBuffer, err)
+	}
+
+	dec = binary.NewDecoding(encodedData)
+
+	_, err = dec.DecodeString()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dec.Remaining() != 0 {
+		t.Fatalf("expected nothing to remain but got %d", dec.Remaining())
+	}
+
+	_, err = dec.DecodeUint64()
+	if err != binary.ErrShortBuffer {
+		t.Fatalf("expected %s but got %v", binary.ErrShortBuffer, err)
+	}
+}
@@ -0,0 +1,115 @@
+package broker
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/nulloop/chu/v2"
+)
+
+const (
+	ackPending int32 = iota
+	ackAcked
+	ackNacked
+	ackExpired
+)
+
+// manualEvent is handed to subscribers which ack their events themselves.
+// The message stays in-flight until it's acked, nacked or expired
+type manualEvent struct {
+	*NatsEvent
+	dispatcher *dispatcher
+	sub        *subscriber
+	msg        *delivery
+	inflight   *InFlight
+	deliveries int
+	cancel     context.CancelFunc
+	state      int32
+}
+
+var _ chu.AckHandle = &manualEvent{}
+
+// settle moves the event out of pending, it fails if the event has been settled before
+func (e *manualEvent) settle(state int32) error {
+	if atomic.CompareAndSwapInt32(&e.state, ackPending, state) {
+		e.cancel()
+		return nil
+	}
+
+	if atomic.LoadInt32(&e.state) == ackExpired {
+		return chu.ErrAckExpired
+	}
+
+	return chu.ErrAlreadyAcked
+}
+
+func (e *manualEvent) Ack() error {
+	err := e.settle(ackAcked)
+	if err != nil {
+		return err
+	}
+
+	defer e.dispatcher.end(e.inflight)
+
+	e.sub.idempotency.Commit(e.id)
+	e.sub.forget(e.msg)
+	return e.msg.ack()
+}
+
+func (e *manualEvent) Nack() error {
+	err := e.settle(ackNacked)
+	if err != nil {
+		return err
+	}
+
+	e.nack()
+	return nil
+}
+
+// nack leaves the message unacked, unless it has been delivered too many times
+func (e *manualEvent) nack() {
+	defer e.dispatcher.end(e.inflight)
+
+	// a redelivery of an event which has not
+	// been processed has to be handled again
+	defer e.sub.idempotency.Release(e.id)
+
+	if e.dispatcher.maxDeliveries > 0 && e.deliveries >= e.dispatcher.maxDeliveries {
+		e.dispatcher.reject(e.sub, e.NatsEvent, e.msg, e.deliveries, "maximum deliveries exceeded")
+	}
+}
+
+// expire nacks the event once ctx is done, unless it has been settled before
+func (e *manualEvent) expire(ctx context.Context) {
+	<-ctx.Done()
+
+	if e.settle(ackExpired) == nil {
+		e.nack()
+	}
+}
+
+// handOver hands the event to a subscriber which acks it itself. The event
+// is nacked a little before its ack wait expires, as process does, so its
+// redelivery is not mistaken for a duplicate.
+func (d *dispatcher) handOver(sub *subscriber, msg *delivery, event *NatsEvent, inflight *InFlight) {
+	if !sub.reserve(msg, event) {
+		d.end(inflight)
+		return
+	}
+
+	ctx, cancel := context.WithDeadline(d.ctx, inflight.Since.Add(sub.ackWait-sub.ackWait/10))
+
+	manual := &manualEvent{
+		NatsEvent:  event,
+		dispatcher: d,
+		sub:        sub,
+		msg:        msg,
+		inflight:   inflight,
+		deliveries: sub.delivered(msg),
+		cancel:     cancel,
+	}
+
+	go manual.expire(ctx)
+
+	sub.handle(ctx, manual)
+}
@@ -0,0 +1,93 @@
+package broker
+
+import (
+	"context"
+	"time"
+
+	"github.com/nulloop/chu/v2"
+	"github.com/nulloop/chu/v2/binary"
+)
+
+var _ chu.Message = &DeadLetter{}
+
+// DeadLetter is the message which is published to the dead-letter topic once
+// a subscriber gives up on an event. Data holds the original envelope untouched,
+// so the event can be re-driven to its source topic by calling Redrive.
+type DeadLetter struct {
+	Topic       string
+	EventID     string
+	AggregateID string
+	Reason      string
+	Deliveries  int
+	FailedAt    time.Time
+	Data        []byte
+}
+
+func (dl *DeadLetter) MsgEncode() ([]byte, error) {
+	return binary.DefaultEncode(dl)
+}
+
+func (dl *DeadLetter) MsgDecode(data []byte) error {
+	return binary.DefaultDecode(data, dl)
+}
+
+// Event decodes the original event which has been dead-lettered. codec
+// should be the same codec the broker uses so the message can be decoded.
+func (dl *DeadLetter) Event(codec ...chu.Codec) (chu.ReceivedEvent, error) {
+	event := &NatsEvent{
+		topic: dl.Topic,
+		codec: codec,
+	}
+
+	err := event.EvtDecode(dl.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return event, nil
+}
+
+// DeadLetterTopic returns the topic which failed events of given topic are
+// published to when no DeadLetterTopic is set in options
+func DeadLetterTopic(topic string) string {
+	return topic + ".deadletter"
+}
+
+// Redrive publishes a dead-lettered event back to its source topic
+func (d *dispatcher) Redrive(dl *DeadLetter) error {
+	return d.publish(context.Background(), dl.Topic, dl.Data)
+}
+
+func (d *dispatcher) deadLetter(event *NatsEvent, data []byte, deliveries int, reason string) error {
+	topic := d.deadLetterTopic
+	if topic == "" {
+		topic = DeadLetterTopic(event.topic)
+	}
+
+	// codecs are not applied to dead letters, the original
+	// envelope has been already encoded by them
+	dlEvent, err := d.newEvent(chu.EventOptions{
+		Topic:       topic,
+		AggregateID: event.aggregateID,
+		CausedBy:    event,
+		Message: &DeadLetter{
+			Topic:       event.topic,
+			EventID:     event.id,
+			AggregateID: event.aggregateID,
+			Reason:      reason,
+			Deliveries:  deliveries,
+			FailedAt:    time.Now(),
+			Data:        data,
+		},
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := dlEvent.EvtEncode()
+	if err != nil {
+		return err
+	}
+
+	return d.publish(context.Background(), topic, encoded)
+}
@@ -0,0 +1,755 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nulloop/chu/v2"
+	"github.com/nulloop/chu/v2/idgen"
+)
+
+// delivery is a transport agnostic view of a message which is handed
+// to a subscriber by one of the brokers in this package
+type delivery struct {
+	data        []byte
+	sequence    uint64
+	timestamp   int64
+	redelivered bool
+	ack         func() error
+}
+
+// subscriber wraps chu.Subscriber with the state dispatcher
+// keeps for each subscription
+type subscriber struct {
+	chu.Subscriber
+	idempotency chu.Idempotency
+	workers     *workers
+	ackWait     time.Duration
+	durableName string
+	mtx         sync.Mutex
+	deliveries  map[uint64]int
+	// target is the last sequence of the channel at subscribe time. Messages
+	// up to target are replayed, the ones after it are live
+	target   uint64
+	known    bool
+	last     uint64
+	replays  uint64
+	caughtUp bool
+	lastAt   time.Time
+	// announced is guarded by dispatcher's subsMtx
+	announced bool
+	// deferred holds the sequences of messages deferred by chu.WarmUpDefer until
+	// they are acked. undeferred is set once they fill the in-flight window, as
+	// the replay can't go on until some of them are acked
+	deferred   map[uint64]struct{}
+	undeferred bool
+	released   bool
+}
+
+// delivered records another delivery of given message and returns how many times
+// it has been delivered so far. A redelivered message which has not been seen by
+// this subscriber, i.e. after a restart, counts as its second delivery.
+func (s *subscriber) delivered(msg *delivery) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	count, ok := s.deliveries[msg.sequence]
+	if !ok && msg.redelivered {
+		count = 1
+	}
+
+	count++
+	s.deliveries[msg.sequence] = count
+
+	return count
+}
+
+// handle calls the subscriber's handler and converts the bool
+// returned by HandleEvent into a Result
+func (s *subscriber) handle(ctx context.Context, event chu.ReceivedEvent) chu.Result {
+	if handler, ok := s.Subscriber.(chu.ContextHandler); ok {
+		return handler.HandleEventContext(ctx, event)
+	}
+
+	if handler, ok := s.Subscriber.(chu.ResultHandler); ok {
+		return handler.HandleEventResult(event)
+	}
+
+	if s.HandleEvent(event) {
+		return chu.Ack()
+	}
+
+	return chu.Retry(0)
+}
+
+// warmUpPolicy returns the policy of the subscriber for replayed events
+func (s *subscriber) warmUpPolicy() chu.WarmUpPolicy {
+	if sub, ok := s.Subscriber.(chu.WarmUpSubscriber); ok {
+		return sub.WarmUpPolicy()
+	}
+
+	if s.Group() != "" {
+		return chu.WarmUpSkip
+	}
+
+	return chu.WarmUpProcess
+}
+
+// deferring is true until the subscriber has caught up or its
+// deferred messages fill its in-flight window. mtx must be held
+func (s *subscriber) deferring() bool {
+	return !s.caughtUp && !s.undeferred
+}
+
+// hold defers given message, so it's left unacked and handled once it's redelivered
+// after the subscriber stops deferring. It returns false if the subscriber has stopped
+// deferring already. window is the in-flight window of the subscription, zero means
+// it's unlimited.
+func (s *subscriber) hold(msg *delivery, window int) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// the message which makes the subscriber catch up is still deferred
+	if s.undeferred {
+		return false
+	}
+
+	s.deferred[msg.sequence] = empty
+
+	// the next delivery of a deferred message counts as its first one
+	if _, ok := s.deliveries[msg.sequence]; !ok {
+		s.deliveries[msg.sequence] = 0
+	}
+
+	if window > 0 && len(s.deferred) >= window {
+		s.undeferred = true
+	}
+
+	return true
+}
+
+// release returns the sequences of deferred messages once the subscriber has
+// stopped deferring, so they can be redelivered. They are returned only once
+func (s *subscriber) release() []uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.deferring() || s.released {
+		return nil
+	}
+
+	s.released = true
+
+	sequences := make([]uint64, 0, len(s.deferred))
+	for seq := range s.deferred {
+		sequences = append(sequences, seq)
+	}
+
+	return sequences
+}
+
+// deferral returns true if given message has been deferred before, and
+// held if it's still deferred as the subscriber has not stopped deferring
+func (s *subscriber) deferral(msg *delivery) (deferred bool, held bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, deferred = s.deferred[msg.sequence]
+	return deferred, deferred && s.deferring()
+}
+
+// window returns the in-flight window of the subscriber, given
+// the broker's default one
+func (s *subscriber) window(fallback int) int {
+	if maxInflight := s.maxInflight(); maxInflight > 0 {
+		return maxInflight
+	}
+
+	return fallback
+}
+
+// reserve reserves the id of given event and returns false if it's a duplicate, which
+// is acked, or if it's still being handled, in which case it's left unacked so it's
+// redelivered in case its handler fails
+func (s *subscriber) reserve(msg *delivery, event *NatsEvent) bool {
+	if s.idempotency.Reserve(event.id) {
+		return true
+	}
+
+	if s.idempotency.Committed(event.id) {
+		msg.ack()
+	}
+
+	return false
+}
+
+func (s *subscriber) forget(msg *delivery) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.deliveries, msg.sequence)
+	delete(s.deferred, msg.sequence)
+}
+
+// newSubscriber wraps given subscriber. Unless the subscriber has its own
+// Idempotency, ids are checked within given scope of the broker's Idempotency.
+// The deprecated UniqueMsgChecker is given the ids as they are, as it
+// might look them up somewhere else
+func (d *dispatcher) newSubscriber(sub chu.Subscriber, scope string) *subscriber {
+	var idempotency chu.Idempotency = scopedIdempotency{
+		Idempotency: d.idempotency,
+		prefix:      scope + "/",
+	}
+
+	switch d.idempotency.(type) {
+	case uniqueMsgChecker, noIdempotency:
+		idempotency = d.idempotency
+	}
+
+	if s, ok := sub.(chu.IdempotentSubscriber); ok {
+		if own := s.Idempotency(); own != nil {
+			idempotency = own
+		}
+	}
+
+	var pool *workers
+	if s, ok := sub.(chu.ConcurrentSubscriber); ok && s.Concurrency() > 1 {
+		pool = newWorkers(s.Concurrency())
+	}
+
+	ackWait := d.ackTimeout
+	if s, ok := sub.(chu.AckWaitSubscriber); ok && s.AckWait() > 0 {
+		ackWait = roundAckWait(s.AckWait())
+	}
+
+	return &subscriber{
+		Subscriber:  sub,
+		idempotency: idempotency,
+		workers:     pool,
+		ackWait:     ackWait,
+		deliveries:  make(map[uint64]int),
+		deferred:    make(map[uint64]struct{}),
+	}
+}
+
+// roundAckWait rounds given ack wait up to whole seconds. NATS streaming
+// truncates ack wait to seconds and rejects anything below a second, so
+// handler deadlines would not match when the message is redelivered
+func roundAckWait(ackWait time.Duration) time.Duration {
+	if rounded := ackWait.Truncate(time.Second); rounded != ackWait {
+		return rounded + time.Second
+	}
+
+	return ackWait
+}
+
+// startPosition returns where the subscriber starts, all messages by default
+func (s *subscriber) startPosition() chu.StartPosition {
+	if sub, ok := s.Subscriber.(chu.PositionedSubscriber); ok {
+		return sub.StartPosition()
+	}
+
+	return chu.StartAll()
+}
+
+// maxInflight returns zero if the subscriber doesn't limit in-flight messages
+func (s *subscriber) maxInflight() int {
+	if sub, ok := s.Subscriber.(chu.MaxInflightSubscriber); ok {
+		return sub.MaxInflight()
+	}
+
+	return 0
+}
+
+// manualAck returns true if the subscriber acks its events itself
+func (s *subscriber) manualAck() bool {
+	if sub, ok := s.Subscriber.(chu.ManualAckSubscriber); ok {
+		return sub.ManualAck()
+	}
+
+	return false
+}
+
+// stop stops the workers of the subscriber once its subscription is closed
+func (s *subscriber) stop() {
+	if s.workers != nil {
+		s.workers.stop()
+	}
+}
+
+// scope returns the name which the ids of events handled by given subscriber are
+// recorded under, so subscribers of the same topic in one process don't treat each
+// other's events as duplicates. Members of a group share their scope as each event
+// is delivered to only one of them. Subscribers which are neither durable nor in a
+// group are numbered in the order they subscribe.
+func (d *dispatcher) scope(sub chu.Subscriber, durableName string) string {
+	if sub.Durable() {
+		scope := d.durableScope(sub, durableName)
+
+		// markers are committed again, so they don't expire before the ids of the scope
+		epoch := d.epoch(scope)
+		d.mark(scope, epoch)
+
+		// a reset durable replays its events under a new scope, so they are handled again
+		if epoch > 0 {
+			return fmt.Sprintf("%s@%d", scope, epoch)
+		}
+
+		return scope
+	}
+
+	if group := sub.Group(); group != "" {
+		return fmt.Sprintf("%s:%s", sub.Topic(), group)
+	}
+
+	return fmt.Sprintf("%s#%d", sub.Topic(), atomic.AddUint64(&d.anonymous, 1))
+}
+
+func (d *dispatcher) durableScope(sub chu.Subscriber, durableName string) string {
+	scope := durableName
+
+	// named durables of different topics may share a name
+	if named, ok := sub.(chu.NamedSubscriber); ok && named.DurableName() != "" {
+		scope = fmt.Sprintf("%s.%s", sub.Topic(), durableName)
+	}
+
+	if group := sub.Group(); group != "" {
+		scope = fmt.Sprintf("%s:%s", scope, group)
+	}
+
+	return scope
+}
+
+// marker returns the id which records the given reset of a durable scope. Unlike
+// the ids of events, it has no slash so they don't collide
+func marker(scope string, epoch uint64) string {
+	return fmt.Sprintf("%s@%d", scope, epoch)
+}
+
+// epoch returns how many times the durable scope has been reset. Resets are committed
+// to the broker's Idempotency next to the ids of the scope, so a persistent one keeps
+// them across restarts
+func (d *dispatcher) epoch(scope string) uint64 {
+	if _, ok := d.idempotency.(uniqueMsgChecker); ok {
+		return 0
+	}
+
+	epoch := uint64(0)
+	for d.idempotency.Committed(marker(scope, epoch+1)) {
+		epoch++
+	}
+
+	return epoch
+}
+
+// mark commits the markers of the durable scope up to given epoch
+func (d *dispatcher) mark(scope string, epoch uint64) {
+	for i := uint64(1); i <= epoch; i++ {
+		id := marker(scope, i)
+
+		d.idempotency.Reserve(id)
+		d.idempotency.Commit(id)
+	}
+}
+
+// reset moves the durable of given subscriber to a new scope
+func (d *dispatcher) reset(sub chu.Subscriber, durableName string) {
+	d.resetMtx.Lock()
+	defer d.resetMtx.Unlock()
+
+	scope := d.durableScope(sub, durableName)
+	d.mark(scope, d.epoch(scope)+1)
+}
+
+// resettable returns false if given subscriber's events are recorded somewhere
+// the broker can't move to a new scope
+func (d *dispatcher) resettable(sub chu.Subscriber) bool {
+	if _, ok := d.idempotency.(uniqueMsgChecker); ok {
+		return false
+	}
+
+	if s, ok := sub.(chu.IdempotentSubscriber); ok && s.Idempotency() != nil {
+		return false
+	}
+
+	return true
+}
+
+// scopedIdempotency prefixes ids with the scope of a subscriber
+type scopedIdempotency struct {
+	chu.Idempotency
+	prefix string
+}
+
+func (s scopedIdempotency) Reserve(id string) bool { return s.Idempotency.Reserve(s.prefix + id) }
+func (s scopedIdempotency) Commit(id string)       { s.Idempotency.Commit(s.prefix + id) }
+func (s scopedIdempotency) Release(id string)      { s.Idempotency.Release(s.prefix + id) }
+func (s scopedIdempotency) Committed(id string) bool {
+	return s.Idempotency.Committed(s.prefix + id)
+}
+
+// defaultIDGenerator uses chu.GenID if it is set, so code
+// which relies on it keeps working, otherwise it uses xid
+type defaultIDGenerator struct{}
+
+func (defaultIDGenerator) NewID() string {
+	if chu.GenID != nil {
+		return chu.GenID()
+	}
+
+	return idgen.XID{}.NewID()
+}
+
+// uniqueMsgChecker adapts the deprecated UniqueMsgChecker option to chu.Idempotency.
+// It records ids as soon as they are reserved, so failed events are not retried.
+type uniqueMsgChecker func(id string) bool
+
+func (u uniqueMsgChecker) Reserve(id string) bool { return u(id) }
+func (u uniqueMsgChecker) Commit(id string)       {}
+func (u uniqueMsgChecker) Release(id string)      {}
+
+// Committed is true as the checker records ids once they are reserved
+func (u uniqueMsgChecker) Committed(id string) bool { return true }
+
+// noIdempotency is used if neither Idempotency nor UniqueMsgChecker is set, so every
+// event is handled
+type noIdempotency struct{}
+
+func (noIdempotency) Reserve(id string) bool   { return true }
+func (noIdempotency) Commit(id string)         {}
+func (noIdempotency) Release(id string)        {}
+func (noIdempotency) Committed(id string) bool { return false }
+
+// newIdempotency picks the idempotency which is set in options
+func newIdempotency(idempotency chu.Idempotency, checker func(id string) bool) chu.Idempotency {
+	switch {
+	case idempotency != nil:
+		return idempotency
+	case checker != nil:
+		return uniqueMsgChecker(checker)
+	default:
+		return noIdempotency{}
+	}
+}
+
+// WarmUpStats counts events which were published before their subscription
+// was made and were received while the broker was warming up
+type WarmUpStats struct {
+	Skipped   uint64 // acked without being handled, see chu.WarmUpSkip
+	Deferred  uint64 // left unacked until the subscription catches up, see chu.WarmUpDefer
+	Processed uint64 // handled right away, see chu.WarmUpProcess
+	// Undeferred are handled right away, as deferred events have filled
+	// the in-flight window of their subscription, see chu.WarmUpDefer
+	Undeferred uint64
+}
+
+// dispatcher contains the logic which is shared between all brokers for
+// handing received messages to subscribers. Keeping it in one place makes sure
+// every broker honors the same ack and redelivery contract.
+type dispatcher struct {
+	// counters are accessed atomically, so they are kept first to be 64-bit aligned
+	anonymous       uint64
+	skipped         uint64
+	deferred        uint64
+	processed       uint64
+	undeferred      uint64
+	ackTimeout      time.Duration
+	ctx             context.Context
+	cancel          context.CancelFunc
+	tick            func()
+	done            func() <-chan struct{}
+	idempotency     chu.Idempotency
+	codec           []chu.Codec
+	maxDeliveries   int
+	deadLetterTopic string
+	envelopeVersion int
+	idGenerator     chu.IDGenerator
+	name            string
+	subsMtx         sync.Mutex
+	subscribers     map[*subscriber]chu.Subscription
+	changed         chan struct{}
+	onCaughtUp      []func(status SubscriptionStatus)
+	resetMtx        sync.Mutex
+	flightMtx       sync.Mutex
+	draining        bool
+	inflight        map[*InFlight]struct{}
+	landed          chan struct{}
+	// maxInflight is the in-flight window of subscriptions which don't
+	// set theirs, zero means it's unlimited
+	maxInflight int
+	// redeliver is optional, brokers which can redeliver messages before
+	// their ack wait expires set it to hand deferred messages over sooner
+	redeliver func(sub *subscriber, sequences []uint64)
+	publish   func(ctx context.Context, topic string, data []byte) error
+	// send publishes data without waiting for its ack, done is called once it's acked.
+	// window bounds the number of events waiting for their ack
+	send   func(topic string, data []byte, done func(err error)) error
+	window chan struct{}
+	// closer, subscribe and deleteDurable are the broker's own
+	// Close, Subscribe and deletion of a durable without open subscriptions
+	closer        func() error
+	subscribe     func(sub chu.Subscriber) (chu.Subscription, error)
+	deleteDurable func(sub chu.Subscriber, name string) error
+}
+
+func (d *dispatcher) dispatch(sub *subscriber, msg *delivery) {
+	inflight, ok := d.begin(sub, msg)
+	if !ok {
+		return
+	}
+
+	event := d.receive(sub, msg)
+	if event == nil {
+		d.end(inflight)
+		return
+	}
+
+	process := func() {
+		if sub.manualAck() {
+			d.handOver(sub, msg, event, inflight)
+			return
+		}
+
+		defer d.end(inflight)
+		d.process(sub, msg, event, inflight.Since)
+	}
+
+	if sub.workers == nil {
+		process()
+		return
+	}
+
+	// events of the same aggregate are handed to the same
+	// worker, so they are handled in the order they are received
+	dropped := func() {
+		d.end(inflight)
+	}
+
+	if !sub.workers.submit(event.aggregateID, process, dropped) {
+		dropped()
+	}
+}
+
+// receive decodes the message, it returns nil if the message
+// doesn't need to be handled. It's called in the order messages
+// are delivered by the broker.
+func (d *dispatcher) receive(sub *subscriber, msg *delivery) *NatsEvent {
+	// redeliveries of deferred messages are neither activity which keeps the
+	// broker warming up nor replayed again. They are handled once the
+	// subscriber stops deferring
+	deferred, held := sub.deferral(msg)
+	if held {
+		return nil
+	}
+
+	if !deferred && !d.replay(sub, msg) {
+		return nil
+	}
+
+	event := &NatsEvent{
+		codec: d.codec,
+	}
+
+	// extract id, aggregate id and bytes from message
+	err := event.EvtDecode(msg.data)
+	if err != nil {
+		// Log the error here
+		msg.ack()
+		return nil
+	}
+
+	event.topic = sub.Topic()
+	// timestamp of messages is in nanoseconds
+	event.createdAt = time.Unix(0, msg.timestamp)
+	event.codec = d.codec
+
+	return event
+}
+
+// replay records the delivery of a message and returns false if it has been
+// published before the subscription was made and is not handled during warm-up
+func (d *dispatcher) replay(sub *subscriber, msg *delivery) bool {
+	d.tick()
+
+	replayed, caughtUp := sub.replayed(msg.sequence)
+	handle := true
+
+	// this `select` is a necessary logic to prevent calling
+	// queue handler during warm-up time. Queue handler should not be called
+	// as they are design to generate more events or talk to external services
+	// generating events are prohabited during warm-up time.
+	select {
+	case <-d.done():
+		// ignore
+	default:
+		// default will be called because we are still in
+		// warmup time and we want to make sure that messages which were
+		// published before the subscription was made are handled
+		// according to the subscriber's warm-up policy.
+		handle = !replayed || d.warmUp(sub, msg)
+	}
+
+	// the message which makes the subscriber catch up
+	// might have been deferred, so it's released too
+	if caughtUp {
+		d.caughtUp(sub)
+	}
+
+	return handle
+}
+
+// release asks the broker to redeliver deferred messages
+// once the subscriber has stopped deferring
+func (d *dispatcher) release(sub *subscriber) {
+	if d.redeliver == nil {
+		return
+	}
+
+	if sequences := sub.release(); len(sequences) > 0 {
+		d.redeliver(sub, sequences)
+	}
+}
+
+// process hands the event to the subscriber until it's acked, retried
+// or dead-lettered. receivedAt is when the message was delivered, as
+// its ack wait started then.
+func (d *dispatcher) process(sub *subscriber, msg *delivery, event *NatsEvent, receivedAt time.Time) {
+	if !sub.reserve(msg, event) {
+		return
+	}
+
+	processed := false
+	defer func() {
+		// a redelivery of an event which has not
+		// been processed has to be handled again
+		if !processed {
+			sub.idempotency.Release(event.id)
+		}
+	}()
+
+	var policy *chu.RetryPolicy
+	if retrier, ok := sub.Subscriber.(chu.Retrier); ok {
+		policy = retrier.RetryPolicy()
+	}
+
+	// handlers have to finish before the broker redelivers the message,
+	// so the deadline is set a little before the ack wait expires
+	ctx, cancel := context.WithDeadline(d.ctx, receivedAt.Add(sub.ackWait-sub.ackWait/10))
+	defer cancel()
+
+	// in process retries are attempts of the same delivery
+	deliveries := sub.delivered(msg)
+
+	for attempt := 1; ; attempt++ {
+		result := sub.handle(ctx, event)
+
+		switch result.Action {
+		case chu.ActionAck:
+			processed = true
+			sub.idempotency.Commit(event.id)
+			sub.forget(msg)
+			msg.ack()
+			return
+		case chu.ActionSkip:
+			sub.forget(msg)
+			msg.ack()
+			return
+		case chu.ActionDeadLetter:
+			d.reject(sub, event, msg, deliveries, result.Reason)
+			return
+		}
+
+		delay := result.Delay
+		retry := delay > 0
+		if !retry && policy != nil && attempt < policy.MaxAttempts {
+			delay = policy.Delay(attempt)
+			retry = true
+		}
+
+		// retrying beyond the ack timeout is pointless as the message
+		// is going to be redelivered by the broker anyway
+		if deadline, _ := ctx.Deadline(); time.Now().Add(delay).After(deadline) {
+			retry = false
+		}
+
+		if !retry {
+			// the last delivery is dead-lettered once it's not retried anymore
+			if d.maxDeliveries > 0 && deliveries >= d.maxDeliveries {
+				d.reject(sub, event, msg, deliveries, "maximum deliveries exceeded")
+			}
+
+			return
+		}
+
+		if !sleep(ctx, delay) {
+			return
+		}
+	}
+}
+
+// warmUp applies the warm-up policy of the subscriber to a replayed
+// message and returns true if the message has to be handled
+func (d *dispatcher) warmUp(sub *subscriber, msg *delivery) bool {
+	switch sub.warmUpPolicy() {
+	case chu.WarmUpSkip:
+		atomic.AddUint64(&d.skipped, 1)
+		msg.ack()
+		return false
+	case chu.WarmUpDefer:
+		if sub.hold(msg, sub.window(d.maxInflight)) {
+			atomic.AddUint64(&d.deferred, 1)
+
+			// the in-flight window might be full now
+			d.release(sub)
+			return false
+		}
+
+		atomic.AddUint64(&d.undeferred, 1)
+		return true
+	default:
+		atomic.AddUint64(&d.processed, 1)
+		return true
+	}
+}
+
+// WarmUpStats returns how many replayed events have been
+// affected by each warm-up policy so far
+func (d *dispatcher) WarmUpStats() WarmUpStats {
+	return WarmUpStats{
+		Skipped:   atomic.LoadUint64(&d.skipped),
+		Deferred:  atomic.LoadUint64(&d.deferred),
+		Processed: atomic.LoadUint64(&d.processed),
+
+		Undeferred: atomic.LoadUint64(&d.undeferred),
+	}
+}
+
+// reject publishes the message to the dead-letter topic and acks it
+func (d *dispatcher) reject(sub *subscriber, event *NatsEvent, msg *delivery, deliveries int, reason string) {
+	err := d.deadLetter(event, msg.data, deliveries, reason)
+	if err != nil {
+		// leave the message unacked, so it will be
+		// dead-lettered on next delivery
+		return
+	}
+
+	sub.forget(msg)
+	msg.ack()
+}
+
+// sleep waits for given duration and returns false if
+// ctx is done in the meantime
+func sleep(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,78 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nulloop/chu/v2"
+)
+
+var (
+	// ErrNotDurable is returned when a durable operation is given a non durable subscriber
+	ErrNotDurable = errors.New("subscriber is not durable")
+	// ErrResetIdempotency is returned by ResetDurable if the subscriber has its own
+	// Idempotency or the broker uses the deprecated UniqueMsgChecker, as replayed
+	// events would be skipped
+	ErrResetIdempotency = errors.New("durable can't be reset with its idempotency")
+)
+
+// durableName returns the name of given subscriber's durable. Unless the subscriber
+// names it, it's prefix followed by the topic, so it's unique per client and topic
+func durableName(prefix string, sub chu.Subscriber) string {
+	if named, ok := sub.(chu.NamedSubscriber); ok && named.DurableName() != "" {
+		return named.DurableName()
+	}
+
+	return fmt.Sprintf("%s.%s", prefix, sub.Topic())
+}
+
+func (d *dispatcher) durableName(sub chu.Subscriber) string {
+	return durableName(d.name, sub)
+}
+
+// DeleteDurable deletes the durable of given subscriber, so subscribing again
+// starts over from the subscriber's start position. Open subscriptions of the
+// durable are unsubscribed. With Nats, durable queue groups are only deleted
+// once their members in other processes have unsubscribed too.
+func (d *dispatcher) DeleteDurable(sub chu.Subscriber) error {
+	if !sub.Durable() {
+		return ErrNotDurable
+	}
+
+	name := d.durableName(sub)
+
+	open := d.durableSubscriptions(sub, name)
+	if len(open) == 0 {
+		return d.deleteDurable(sub, name)
+	}
+
+	// unsubscribing the last subscription deletes the durable
+	var err error
+	for _, subscription := range open {
+		if unsubscribeErr := subscription.Unsubscribe(); err == nil {
+			err = unsubscribeErr
+		}
+	}
+
+	return err
+}
+
+// ResetDurable deletes the durable of given subscriber and subscribes it again,
+// so it replays its channel from its start position. Replayed events are handled
+// again even if the broker's Idempotency has recorded them, as the reset is recorded
+// in it too. A persistent Idempotency keeps the reset across restarts. Subscribers
+// with their own Idempotency can't be reset, ErrResetIdempotency is returned.
+func (d *dispatcher) ResetDurable(sub chu.Subscriber) (chu.Subscription, error) {
+	if sub.Durable() && !d.resettable(sub) {
+		return nil, ErrResetIdempotency
+	}
+
+	err := d.DeleteDurable(sub)
+	if err != nil {
+		return nil, err
+	}
+
+	d.reset(sub, d.durableName(sub))
+
+	return d.subscribe(sub)
+}
@@ -0,0 +1,336 @@
+package broker
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/nulloop/chu/v2/binary"
+)
+
+// Envelope versions which NatsEvent can be encoded to and decoded from.
+const (
+	// EnvelopeV2 is the layout of chu v2 publishers. It has no header and consists of
+	// id, aggregate id and body, optionally followed by an extension which older
+	// consumers ignore:
+	//
+	// 0: no extension
+	// 1: headers
+	// 2: correlation id and causation id
+	EnvelopeV2 = 2
+	// EnvelopeV3 starts with envelopeMagic and the version byte followed by id,
+	// aggregate id, correlation id, causation id, headers and body.
+	EnvelopeV3 = 3
+	// EnvelopeV4 is EnvelopeV3 followed by the time the event occurred at.
+	EnvelopeV4 = 4
+	// EnvelopeLatest is used when no envelope version is set in options
+	EnvelopeLatest = EnvelopeV4
+)
+
+// envelopeV2Extension is the latest extension which is appended to EnvelopeV2
+const envelopeV2Extension = 2
+
+// envelopeMagic can't be mistaken for an EnvelopeV2 as the first 8 bytes of
+// EnvelopeV2 are the uvarint encoded length of id. Ids shorter than 128 bytes are
+// encoded into the first byte and the rest are zero.
+var envelopeMagic = []byte("CHU")
+
+var ErrUnsupportedEnvelope = errors.New("unsupported envelope version")
+
+func validEnvelope(version int) bool {
+	return version == 0 || (version >= EnvelopeV2 && version <= EnvelopeLatest)
+}
+
+func sortedKeys(headers map[string]string) []string {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func headersSize(headers map[string]string) int {
+	size := 8
+	for key, value := range headers {
+		size += len(key) + 8
+		size += len(value) + 8
+	}
+
+	return size
+}
+
+// encodeHeaders encodes headers sorted by key, so
+// the same event is always encoded to the same bytes
+func encodeHeaders(bin *binary.SimpleBinary, headers map[string]string) error {
+	err := bin.EncodeUint64(uint64(len(headers)))
+	if err != nil {
+		return err
+	}
+
+	for _, key := range sortedKeys(headers) {
+		err = bin.EncodeString(key)
+		if err != nil {
+			return err
+		}
+
+		err = bin.EncodeString(headers[key])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func decodeHeaders(bin *binary.SimpleBinary) (map[string]string, error) {
+	count, err := bin.DecodeUint64()
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string]string)
+
+	for i := uint64(0); i < count; i++ {
+		key, err := bin.DecodeString()
+		if err != nil {
+			return nil, err
+		}
+
+		headers[key], err = bin.DecodeString()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return headers, nil
+}
+
+func encodeV2(evt *NatsEvent) ([]byte, error) {
+	var err error
+
+	size := len(evt.id) + 8
+	size += len(evt.aggregateID) + 8
+	size += len(evt.body) + 8
+	size += 8
+	size += headersSize(evt.headers)
+	size += len(evt.correlationID) + 8
+	size += len(evt.causationID) + 8
+
+	bin := binary.NewEncoding(size)
+
+	err = bin.EncodeString(evt.id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bin.EncodeString(evt.aggregateID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bin.EncodeBytes(evt.body)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bin.EncodeUint64(envelopeV2Extension)
+	if err != nil {
+		return nil, err
+	}
+
+	err = encodeHeaders(bin, evt.headers)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bin.EncodeString(evt.correlationID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bin.EncodeString(evt.causationID)
+	if err != nil {
+		return nil, err
+	}
+
+	return bin.Bytes(), nil
+}
+
+func decodeV2(evt *NatsEvent, data []byte) error {
+	var err error
+
+	bin := binary.NewDecoding(data)
+
+	evt.id, err = bin.DecodeString()
+	if err != nil {
+		return err
+	}
+
+	evt.aggregateID, err = bin.DecodeString()
+	if err != nil {
+		return err
+	}
+
+	evt.body, err = bin.DecodeBytes()
+	if err != nil {
+		return err
+	}
+
+	// envelopes which are produced by older publishers end here
+	if bin.Remaining() == 0 {
+		return nil
+	}
+
+	extension, err := bin.DecodeUint64()
+	if err != nil {
+		return err
+	}
+
+	if extension < 1 {
+		return nil
+	}
+
+	evt.headers, err = decodeHeaders(bin)
+	if err != nil {
+		return err
+	}
+
+	if extension < 2 {
+		return nil
+	}
+
+	evt.correlationID, err = bin.DecodeString()
+	if err != nil {
+		return err
+	}
+
+	evt.causationID, err = bin.DecodeString()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// encodeV3 encodes both EnvelopeV3 and EnvelopeV4
+func encodeV3(evt *NatsEvent, version byte) ([]byte, error) {
+	var err error
+
+	size := len(envelopeMagic) + 1
+	size += len(evt.id) + 8
+	size += len(evt.aggregateID) + 8
+	size += len(evt.correlationID) + 8
+	size += len(evt.causationID) + 8
+	size += headersSize(evt.headers)
+	size += len(evt.body) + 8
+	if version >= EnvelopeV4 {
+		size += len(evt.occurredAt.Format(time.RFC3339Nano)) + 8
+	}
+
+	bin := binary.NewEncoding(size)
+
+	err = bin.EncodeRaw(envelopeMagic)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bin.EncodeRaw([]byte{version})
+	if err != nil {
+		return nil, err
+	}
+
+	err = bin.EncodeString(evt.id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bin.EncodeString(evt.aggregateID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bin.EncodeString(evt.correlationID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bin.EncodeString(evt.causationID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = encodeHeaders(bin, evt.headers)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bin.EncodeBytes(evt.body)
+	if err != nil {
+		return nil, err
+	}
+
+	if version >= EnvelopeV4 {
+		err = bin.EncodeTime(evt.occurredAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return bin.Bytes(), nil
+}
+
+// decodeV3 decodes both EnvelopeV3 and EnvelopeV4
+func decodeV3(evt *NatsEvent, data []byte) error {
+	var err error
+
+	bin := binary.NewDecoding(data)
+
+	// magic bytes and version are already checked by EvtDecode
+	_, err = bin.DecodeRaw(len(envelopeMagic) + 1)
+	if err != nil {
+		return err
+	}
+
+	evt.id, err = bin.DecodeString()
+	if err != nil {
+		return err
+	}
+
+	evt.aggregateID, err = bin.DecodeString()
+	if err != nil {
+		return err
+	}
+
+	evt.correlationID, err = bin.DecodeString()
+	if err != nil {
+		return err
+	}
+
+	evt.causationID, err = bin.DecodeString()
+	if err != nil {
+		return err
+	}
+
+	evt.headers, err = decodeHeaders(bin)
+	if err != nil {
+		return err
+	}
+
+	evt.body, err = bin.DecodeBytes()
+	if err != nil {
+		return err
+	}
+
+	if evt.version < EnvelopeV4 {
+		return nil
+	}
+
+	evt.occurredAt, err = bin.DecodeTime()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,249 @@
+package broker_test
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nulloop/chu/v2"
+	"github.com/nulloop/chu/v2/binary"
+	"github.com/nulloop/chu/v2/broker"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+var occurredAt = time.Date(2019, time.April, 1, 10, 30, 0, 123456789, time.UTC)
+
+type rawMessage []byte
+
+func (r *rawMessage) MsgEncode() ([]byte, error) {
+	return *r, nil
+}
+
+func (r *rawMessage) MsgDecode(data []byte) error {
+	*r = append((*r)[:0], data...)
+	return nil
+}
+
+func goldenEvent(t *testing.T, version int) chu.Event {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		EnvelopeVersion: version,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	msg := rawMessage("Hello World")
+
+	event, err := memory.CreateEvent(chu.EventOptions{
+		Topic:         "a.b.c",
+		ID:            "bj2g9f0rtdi1ue3ngvs0",
+		AggregateID:   "aggregate",
+		CorrelationID: "correlation",
+		CausationID:   "causation",
+		OccurredAt:    occurredAt,
+		Message:       &msg,
+		Headers: map[string]string{
+			"content-type": "text/plain",
+			"tenant":       "nulloop",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return event
+}
+
+func golden(t *testing.T, name string, data []byte) []byte {
+	path := filepath.Join("testdata", name)
+
+	if *update {
+		err := ioutil.WriteFile(path, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return expected
+}
+
+func TestEnvelopeGolden(t *testing.T) {
+	testCases := []struct {
+		golden  string
+		version int
+	}{
+		{golden: "envelope_v2.golden", version: broker.EnvelopeV2},
+		{golden: "envelope_v3.golden", version: broker.EnvelopeV3},
+		{golden: "envelope_v4.golden", version: broker.EnvelopeV4},
+	}
+
+	for _, testCase := range testCases {
+		data, err := goldenEvent(t, testCase.version).(chu.EventEncoder).EvtEncode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := golden(t, testCase.golden, data)
+
+		if !bytes.Equal(data, expected) {
+			t.Fatalf("expected %s to be locked as %q but got %q", testCase.golden, expected, data)
+		}
+
+		event := &broker.NatsEvent{}
+		err = event.EvtDecode(expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg := rawMessage{}
+		err = event.Message(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if event.ID() != "bj2g9f0rtdi1ue3ngvs0" ||
+			event.AggregateID() != "aggregate" ||
+			event.CorrelationID() != "correlation" ||
+			event.CausationID() != "causation" ||
+			event.Headers()["tenant"] != "nulloop" ||
+			string(msg) != "Hello World" {
+			t.Fatalf("unexpected decoded event from %s: %+v", testCase.golden, event)
+		}
+
+		// only EnvelopeV4 carries the time event occurred at
+		if (testCase.version >= broker.EnvelopeV4) != event.OccurredAt().Equal(occurredAt) {
+			t.Fatalf("unexpected decoded event from %s: %+v", testCase.golden, event)
+		}
+	}
+}
+
+func TestEnvelopeLegacyGolden(t *testing.T) {
+	// the layout produced by chu v2 publishers, before envelopes were versioned
+	enc := binary.NewEncoding(100)
+	enc.EncodeString("bj2g9f0rtdi1ue3ngvs0")
+	enc.EncodeString("aggregate")
+	enc.EncodeBytes([]byte("Hello World"))
+
+	expected := golden(t, "envelope_v2_legacy.golden", enc.Bytes())
+
+	event := &broker.NatsEvent{}
+	err := event.EvtDecode(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event.ID() != "bj2g9f0rtdi1ue3ngvs0" || event.AggregateID() != "aggregate" || event.CorrelationID() != event.ID() {
+		t.Fatalf("unexpected decoded event %+v", event)
+	}
+}
+
+func TestEnvelopeUnsupported(t *testing.T) {
+	event := &broker.NatsEvent{}
+
+	err := event.EvtDecode([]byte("CHU\x09"))
+	if err != broker.ErrUnsupportedEnvelope {
+		t.Fatalf("expected %s but got %v", broker.ErrUnsupportedEnvelope, err)
+	}
+
+	_, err = broker.NewMemory(&broker.MemoryOptions{
+		EnvelopeVersion: 9,
+	})
+	if err != broker.ErrUnsupportedEnvelope {
+		t.Fatalf("expected %s but got %v", broker.ErrUnsupportedEnvelope, err)
+	}
+}
+
+func TestEnvelopeHeaders(t *testing.T) {
+	// consumers running chu v2 can only decode EnvelopeV2
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		EnvelopeVersion: broker.EnvelopeV2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	event, err := memory.CreateEvent(chu.EventOptions{
+		Topic:       "a.b.c",
+		AggregateID: "aggregate",
+		Message:     &message{Message: "Hello World"},
+		Headers: map[string]string{
+			"content-type": "application/gob",
+			"tenant":       "nulloop",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := event.(chu.EventEncoder).EvtEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := &broker.NatsEvent{}
+	err = decoded.EvtDecode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.ID() != event.ID() || decoded.Headers()["tenant"] != "nulloop" || decoded.Headers()["content-type"] != "application/gob" {
+		t.Fatalf("unexpected decoded event %+v", decoded)
+	}
+
+	// consumers which don't know about headers decode id, aggregate id and body only
+	dec := binary.NewDecoding(data)
+
+	id, err := dec.DecodeString()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aggregateID, err := dec.DecodeString()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := dec.DecodeBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &message{}
+	err = msg.MsgDecode(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id != event.ID() || aggregateID != "aggregate" || msg.Message != "Hello World" {
+		t.Fatalf("old consumer failed to decode new envelope: %s %s %s", id, aggregateID, msg.Message)
+	}
+
+	// envelopes from publishers which don't know about headers
+	enc := binary.NewEncoding(len(id) + len(aggregateID) + len(body) + 24)
+	enc.EncodeString(id)
+	enc.EncodeString(aggregateID)
+	enc.EncodeBytes(body)
+
+	decoded = &broker.NatsEvent{}
+	err = decoded.EvtDecode(enc.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.ID() != event.ID() || len(decoded.Headers()) != 0 {
+		t.Fatalf("unexpected decoded event %+v", decoded)
+	}
+}
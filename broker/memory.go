@@ -0,0 +1,593 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	stan "github.com/nats-io/go-nats-streaming"
+
+	"github.com/nulloop/chu/v2"
+	"github.com/nulloop/chu/v2/heartbeat"
+)
+
+var _ chu.Broker = &Memory{}
+var _ chu.Subscription = &memorySubscription{}
+
+var (
+	ErrMemoryClosed          = errors.New("memory broker is closed")
+	ErrMemoryBadSubscription = errors.New("invalid subscription")
+)
+
+type memoryMsg struct {
+	sequence  uint64
+	data      []byte
+	timestamp int64
+}
+
+// memoryConsumer holds the delivery state of either a single subscription
+// or a queue group. Durable consumers are kept around after their last member
+// is closed so they can resume from where they left off.
+type memoryConsumer struct {
+	key         string
+	topic       string
+	durable     bool
+	ackWait     time.Duration
+	maxInflight int
+	next        uint64
+	pending     map[uint64]time.Time
+	members     []*memorySubscription
+	turn        int
+	notify      chan struct{}
+	quit        chan struct{}
+}
+
+func (c *memoryConsumer) wake() {
+	select {
+	case c.notify <- empty:
+	default:
+	}
+}
+
+type memorySubscription struct {
+	broker   *Memory
+	consumer *memoryConsumer
+	sub      *subscriber
+}
+
+func (s *memorySubscription) Unsubscribe() error {
+	return s.broker.leave(s, true)
+}
+
+func (s *memorySubscription) Close() error {
+	return s.broker.leave(s, false)
+}
+
+// Status reports the progress of the subscription replaying its channel
+func (s *memorySubscription) Status() SubscriptionStatus {
+	return s.sub.status()
+}
+
+var empty struct{}
+
+// Memory is an in process implementation of chu.Broker. It follows the same
+// delivery rules as Nats, durable subscriptions, queue groups, manual ack and
+// redelivery after AckTimeout, without the need of a running server. It is
+// meant to be used in unit tests and single process applications.
+type Memory struct {
+	dispatcher
+	mtx       sync.Mutex
+	channels  map[string][]*memoryMsg
+	consumers map[string]*memoryConsumer
+	counter   int
+	closed    bool
+}
+
+func (m *Memory) Publish(event chu.Event) error {
+	return m.PublishContext(context.Background(), event)
+}
+
+func (m *Memory) PublishContext(ctx context.Context, event chu.Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	data, err := encodeEvent(event)
+	if err != nil {
+		return err
+	}
+
+	return m.store(event.Topic(), data)
+}
+
+// store appends data to the channel of given topic and wakes up its consumers
+func (m *Memory) store(topic string, data []byte) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.closed {
+		return ErrMemoryClosed
+	}
+
+	channel := m.channels[topic]
+
+	m.channels[topic] = append(channel, &memoryMsg{
+		sequence:  uint64(len(channel) + 1),
+		data:      data,
+		timestamp: time.Now().UnixNano(),
+	})
+
+	for _, consumer := range m.consumers {
+		if consumer.topic == topic {
+			consumer.wake()
+		}
+	}
+
+	return nil
+}
+
+// deleteIdleDurable deletes the delivery state of a durable
+// which has no open subscriptions
+func (m *Memory) deleteIdleDurable(sub chu.Subscriber, _ string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	key := m.consumerKey(sub)
+	if consumer, ok := m.consumers[key]; ok && len(consumer.members) == 0 {
+		delete(m.consumers, key)
+	}
+
+	return nil
+}
+
+// consumerKey returns the key which identifies the delivery state of given subscriber.
+// Subscribers which share a key, share the state.
+func (m *Memory) consumerKey(sub chu.Subscriber) string {
+	topic := sub.Topic()
+	group := sub.Group()
+
+	switch {
+	case sub.Durable() && group != "":
+		return fmt.Sprintf("durable-group:%s:%s:%s", topic, m.durableName(sub), group)
+	case sub.Durable():
+		return fmt.Sprintf("durable:%s:%s", topic, m.durableName(sub))
+	case group != "":
+		return fmt.Sprintf("group:%s:%s", topic, group)
+	default:
+		m.counter++
+		return fmt.Sprintf("sub:%s:%d", topic, m.counter)
+	}
+}
+
+func (m *Memory) Subscribe(sub chu.Subscriber) (chu.Subscription, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.closed {
+		return nil, ErrMemoryClosed
+	}
+
+	key := m.consumerKey(sub)
+
+	consumer, ok := m.consumers[key]
+	if ok && sub.Group() == "" && len(consumer.members) > 0 {
+		return nil, fmt.Errorf("duplicate durable registration for %s", key)
+	}
+
+	subscription := &memorySubscription{
+		broker: m,
+		sub:    m.newSubscriber(sub, m.scope(sub, m.durableName(sub))),
+	}
+
+	subscription.sub.durableName = m.durableName(sub)
+
+	// the first member of a group decides where
+	// the group starts and how it's delivered to
+	if !ok {
+		consumer = &memoryConsumer{
+			key:         key,
+			topic:       sub.Topic(),
+			durable:     sub.Durable(),
+			ackWait:     subscription.sub.ackWait,
+			maxInflight: subscription.sub.maxInflight(),
+			next:        m.startSequence(sub.Topic(), subscription.sub.startPosition()),
+			pending:     make(map[uint64]time.Time),
+			notify:      make(chan struct{}, 1),
+		}
+		m.consumers[key] = consumer
+	}
+
+	subscription.consumer = consumer
+
+	// a durable consumer which has already received every
+	// message of the channel has nothing to replay
+	last := uint64(len(m.channels[sub.Topic()]))
+	if consumer.next > last {
+		last = 0
+	}
+
+	m.register(subscription.sub, subscription)
+
+	if subscription.sub.setTarget(last) {
+		// callbacks might publish, so they can't be called while mtx is held
+		go m.caughtUp(subscription.sub)
+	}
+
+	consumer.members = append(consumer.members, subscription)
+
+	if len(consumer.members) == 1 {
+		// anything left unacked by previous members of a durable
+		// consumer has to be redelivered right away
+		now := time.Now()
+		for seq := range consumer.pending {
+			consumer.pending[seq] = now
+		}
+
+		consumer.quit = make(chan struct{})
+		go m.run(consumer, consumer.quit)
+	}
+
+	return subscription, nil
+}
+
+// redeliverDeferred redelivers given messages of the subscriber right away,
+// rather than once their ack wait expires
+func (m *Memory) redeliverDeferred(sub *subscriber, sequences []uint64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, consumer := range m.consumers {
+		for _, member := range consumer.members {
+			if member.sub != sub {
+				continue
+			}
+
+			now := time.Now()
+			for _, seq := range sequences {
+				if _, ok := consumer.pending[seq]; ok {
+					consumer.pending[seq] = now
+				}
+			}
+
+			consumer.wake()
+			return
+		}
+	}
+}
+
+// startSequence returns the sequence of the first message of given topic
+// which is delivered to a subscription starting at given position
+func (m *Memory) startSequence(topic string, position chu.StartPosition) uint64 {
+	channel := m.channels[topic]
+	last := uint64(len(channel))
+
+	switch position.Position {
+	case chu.PositionNew:
+		return last + 1
+	case chu.PositionLastReceived:
+		if last == 0 {
+			return 1
+		}
+
+		return last
+	case chu.PositionSequence:
+		if position.Sequence == 0 {
+			return 1
+		}
+
+		return position.Sequence
+	case chu.PositionTime, chu.PositionAgo:
+		since := position.Time
+		if position.Position == chu.PositionAgo {
+			since = time.Now().Add(-position.Ago)
+		}
+
+		for _, msg := range channel {
+			if msg.timestamp >= since.UnixNano() {
+				return msg.sequence
+			}
+		}
+
+		return last + 1
+	default:
+		return 1
+	}
+}
+
+func (m *Memory) leave(subscription *memorySubscription, unsubscribe bool) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	consumer := subscription.consumer
+
+	idx := -1
+	for i, member := range consumer.members {
+		if member == subscription {
+			idx = i
+			break
+		}
+	}
+
+	if idx == -1 {
+		return ErrMemoryBadSubscription
+	}
+
+	m.unregister(subscription.sub)
+	subscription.sub.stop()
+
+	consumer.members = append(consumer.members[:idx], consumer.members[idx+1:]...)
+	if len(consumer.members) > 0 {
+		return nil
+	}
+
+	close(consumer.quit)
+
+	if unsubscribe || !consumer.durable {
+		delete(m.consumers, consumer.key)
+	}
+
+	return nil
+}
+
+// run delivers messages to the members of given consumer one at a time
+// until quit is closed.
+func (m *Memory) run(consumer *memoryConsumer, quit chan struct{}) {
+	for {
+		member, msg, sleep, ok := m.poll(consumer, quit)
+		if !ok {
+			return
+		}
+
+		if member != nil {
+			m.dispatch(member.sub, msg)
+			continue
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if sleep > 0 {
+			timer = time.NewTimer(sleep)
+			timeout = timer.C
+		}
+
+		select {
+		case <-quit:
+		case <-consumer.notify:
+		case <-timeout:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// poll finds the next message which needs to be delivered to the consumer. Messages
+// whose ack wait has expired are redelivered before new ones. If there is nothing
+// to deliver, poll returns how long the consumer can sleep until the next redelivery
+// is due, zero means until it is woken up.
+func (m *Memory) poll(consumer *memoryConsumer, quit chan struct{}) (*memorySubscription, *delivery, time.Duration, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if consumer.quit != quit || len(consumer.members) == 0 {
+		return nil, nil, 0, false
+	}
+
+	now := time.Now()
+
+	var seq uint64
+	var sleep time.Duration
+
+	for pending, deadline := range consumer.pending {
+		if !deadline.After(now) {
+			if seq == 0 || pending < seq {
+				seq = pending
+			}
+			continue
+		}
+
+		if d := deadline.Sub(now); sleep == 0 || d < sleep {
+			sleep = d
+		}
+	}
+
+	channel := m.channels[consumer.topic]
+	redelivered := seq != 0
+
+	if seq == 0 {
+		if consumer.next > uint64(len(channel)) {
+			return nil, nil, sleep, true
+		}
+
+		if consumer.maxInflight > 0 && len(consumer.pending) >= consumer.maxInflight {
+			return nil, nil, sleep, true
+		}
+
+		seq = consumer.next
+		consumer.next++
+	}
+
+	consumer.pending[seq] = now.Add(consumer.ackWait)
+
+	member := consumer.members[consumer.turn%len(consumer.members)]
+	consumer.turn++
+
+	msg := channel[seq-1]
+
+	return member, &delivery{
+		data:        msg.data,
+		sequence:    msg.sequence,
+		timestamp:   msg.timestamp,
+		redelivered: redelivered,
+		ack: func() error {
+			return m.ack(consumer, msg.sequence)
+		},
+	}, 0, true
+}
+
+func (m *Memory) ack(consumer *memoryConsumer, seq uint64) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	delete(consumer.pending, seq)
+
+	// a consumer which is limited by maxInflight can move on
+	consumer.wake()
+
+	return nil
+}
+
+func (m *Memory) CreateEvent(eventOpts chu.EventOptions) (chu.Event, error) {
+	return m.CreateEventContext(context.Background(), eventOpts)
+}
+
+func (m *Memory) CreateEventContext(ctx context.Context, eventOpts chu.EventOptions) (chu.Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	event, err := m.newEvent(eventOpts, m.codec)
+	if err != nil {
+		return nil, err
+	}
+
+	return event, nil
+}
+
+func (m *Memory) Wait() error {
+	return m.WaitContext(context.Background())
+}
+
+// Health reports the state of subscriptions. Memory is connected until it's closed
+func (m *Memory) Health() Health {
+	health := m.health()
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	health.Connection = "CONNECTED"
+	health.Session = !m.closed
+
+	if m.closed {
+		health.Connection = "CLOSED"
+	}
+
+	return health
+}
+
+func (m *Memory) Close() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.closed {
+		return nil
+	}
+
+	m.closed = true
+	m.cancel()
+	m.stopWorkers()
+
+	for _, consumer := range m.consumers {
+		if len(consumer.members) > 0 {
+			consumer.members = nil
+			close(consumer.quit)
+		}
+	}
+
+	return nil
+}
+
+type MemoryOptions struct {
+	ClientID           string
+	Codec              []chu.Codec
+	AckTimeout         time.Duration // unlike Nats, not rounded to whole seconds so tests can use short timeouts
+	WarmUpTimeout      time.Duration
+	Idempotency        chu.Idempotency
+	UniqueMsgChecker   func(id string) bool // Deprecated: use Idempotency
+	MaxDeliveries      int
+	DeadLetterTopic    string
+	EnvelopeVersion    int
+	IDGenerator        chu.IDGenerator
+	MaxPublishInflight int // events are acked as soon as they are stored
+}
+
+// NewMemory creates an in process broker. It accepts the same options as
+// NewNats minus the connection related ones, so it can be swapped with Nats
+// in tests.
+func NewMemory(opt *MemoryOptions) (*Memory, error) {
+	broker := &Memory{
+		dispatcher: dispatcher{
+			ackTimeout:      opt.AckTimeout,
+			idempotency:     newIdempotency(opt.Idempotency, opt.UniqueMsgChecker),
+			codec:           opt.Codec,
+			maxDeliveries:   opt.MaxDeliveries,
+			deadLetterTopic: opt.DeadLetterTopic,
+			envelopeVersion: opt.EnvelopeVersion,
+			idGenerator:     opt.IDGenerator,
+			name:            opt.ClientID,
+			subscribers:     make(map[*subscriber]chu.Subscription),
+			changed:         make(chan struct{}),
+			inflight:        make(map[*InFlight]struct{}),
+			landed:          make(chan struct{}),
+		},
+		channels:  make(map[string][]*memoryMsg),
+		consumers: make(map[string]*memoryConsumer),
+	}
+
+	if !validEnvelope(broker.envelopeVersion) {
+		return nil, ErrUnsupportedEnvelope
+	}
+
+	if broker.idGenerator == nil {
+		broker.idGenerator = defaultIDGenerator{}
+	}
+
+	broker.ctx, broker.cancel = context.WithCancel(context.Background())
+
+	broker.closer = broker.Close
+	broker.subscribe = broker.Subscribe
+	broker.deleteDurable = broker.deleteIdleDurable
+
+	broker.publish = func(ctx context.Context, topic string, data []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		return broker.store(topic, data)
+	}
+
+	maxPublishInflight := opt.MaxPublishInflight
+	if maxPublishInflight <= 0 {
+		maxPublishInflight = stan.DefaultMaxPubAcksInflight
+	}
+
+	broker.window = make(chan struct{}, maxPublishInflight)
+
+	// deferred messages might be released while mtx is held
+	broker.redeliver = func(sub *subscriber, sequences []uint64) {
+		go broker.redeliverDeferred(sub, sequences)
+	}
+
+	broker.send = func(topic string, data []byte, done func(err error)) error {
+		err := broker.store(topic, data)
+		if err != nil {
+			return err
+		}
+
+		done(nil)
+		return nil
+	}
+
+	if broker.ackTimeout <= 0 {
+		broker.ackTimeout = stan.DefaultAckWait
+	}
+
+	_, broker.tick, broker.done = heartbeat.New(opt.WarmUpTimeout)
+
+	go broker.finishWarmUp()
+
+	return broker, nil
+}
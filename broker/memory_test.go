@@ -0,0 +1,2221 @@
+package broker_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nulloop/chu/v2"
+	"github.com/nulloop/chu/v2/broker"
+	"github.com/nulloop/chu/v2/unique"
+)
+
+type handlerSub struct {
+	topic   string
+	durable bool
+	group   string
+	handle  func(event chu.ReceivedEvent) bool
+}
+
+func (h *handlerSub) Topic() string {
+	return h.topic
+}
+func (h *handlerSub) Durable() bool {
+	return h.durable
+}
+func (h *handlerSub) Group() string {
+	return h.group
+}
+func (h *handlerSub) HandleEvent(event chu.ReceivedEvent) bool {
+	return h.handle(event)
+}
+
+func publish(t *testing.T, b chu.Broker, topic string) chu.Event {
+	event, err := b.CreateEvent(chu.EventOptions{
+		Topic: topic,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Publish(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return event
+}
+
+func TestMemory(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID: "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	msgChan := make(chan string, 1)
+	errChan := make(chan error, 1)
+
+	subscription, err := memory.Subscribe(&dummySub{
+		err: errChan,
+		msg: msgChan,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Unsubscribe()
+
+	event, err := memory.CreateEvent(chu.EventOptions{
+		Topic: "a.b.c",
+		Message: &message{
+			Message: "Hello World",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	memory.Wait()
+
+	err = memory.Publish(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-msgChan:
+		if strings.Index(msg, "Hello World") == -1 {
+			t.Fatalf("expected %s but got %s", "Hello World", msg)
+		}
+	case err := <-errChan:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("got not message")
+	}
+}
+
+func TestMemoryRedelivery(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID:   "foo",
+		AckTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	var count int32
+	ids := make(chan string, 2)
+
+	_, err = memory.Subscribe(&handlerSub{
+		topic: "a.b.c",
+		handle: func(event chu.ReceivedEvent) bool {
+			ids <- event.ID()
+			// reject the first delivery
+			return atomic.AddInt32(&count, 1) == 2
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := publish(t, memory, "a.b.c")
+
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-ids:
+			if id != event.ID() {
+				t.Fatalf("expected %s but got %s", event.ID(), id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("event was not redelivered")
+		}
+	}
+}
+
+func TestMemoryDurable(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID: "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	ids := make(chan string, 10)
+	sub := &handlerSub{
+		topic:   "a.b.c",
+		durable: true,
+		handle: func(event chu.ReceivedEvent) bool {
+			ids <- event.ID()
+			return true
+		},
+	}
+
+	subscription, err := memory.Subscribe(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, memory, "a.b.c")
+	<-ids
+
+	err = subscription.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := publish(t, memory, "a.b.c")
+
+	subscription, err = memory.Subscribe(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Unsubscribe()
+
+	select {
+	case id := <-ids:
+		if id != event.ID() {
+			t.Fatalf("expected durable to resume from %s but got %s", event.ID(), id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("durable subscription did not resume")
+	}
+}
+
+func TestMemoryQueueGroup(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID: "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	var mtx sync.Mutex
+	counts := make(map[string]int)
+	done := make(chan struct{}, 10)
+
+	for i := 0; i < 2; i++ {
+		_, err := memory.Subscribe(&handlerSub{
+			topic: "a.b.c",
+			group: "workers",
+			handle: func(event chu.ReceivedEvent) bool {
+				mtx.Lock()
+				counts[event.ID()]++
+				mtx.Unlock()
+				done <- empty
+				return true
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	memory.Wait()
+
+	for i := 0; i < 10; i++ {
+		publish(t, memory, "a.b.c")
+	}
+
+	for i := 0; i < 10; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("not all events were delivered")
+		}
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	for id, count := range counts {
+		if count != 1 {
+			t.Fatalf("expected %s to be delivered once but got %d", id, count)
+		}
+	}
+}
+
+var empty struct{}
+
+func TestMemoryDeadLetter(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID:      "foo",
+		AckTimeout:    50 * time.Millisecond,
+		MaxDeliveries: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	var redriven int32
+	deliveries := make(chan string, 3)
+	deadLetters := make(chan *broker.DeadLetter, 1)
+
+	_, err = memory.Subscribe(&handlerSub{
+		topic: "a.b.c",
+		handle: func(event chu.ReceivedEvent) bool {
+			deliveries <- event.ID()
+			return atomic.LoadInt32(&redriven) == 1
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = memory.Subscribe(&handlerSub{
+		topic: broker.DeadLetterTopic("a.b.c"),
+		handle: func(event chu.ReceivedEvent) bool {
+			dl := &broker.DeadLetter{}
+			err := event.Message(dl)
+			if err != nil {
+				t.Error(err)
+			}
+
+			deadLetters <- dl
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := publish(t, memory, "a.b.c")
+
+	var dl *broker.DeadLetter
+
+	select {
+	case dl = <-deadLetters:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not dead-lettered")
+	}
+
+	if dl.EventID != event.ID() || dl.Topic != "a.b.c" || dl.Deliveries != 2 {
+		t.Fatalf("unexpected dead letter %+v", dl)
+	}
+
+	original, err := dl.Event()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if original.ID() != event.ID() {
+		t.Fatalf("expected original event %s but got %s", event.ID(), original.ID())
+	}
+
+	if len(deliveries) != 2 {
+		t.Fatalf("expected 2 deliveries before dead-lettering but got %d", len(deliveries))
+	}
+
+	<-deliveries
+	<-deliveries
+
+	atomic.StoreInt32(&redriven, 1)
+
+	err = memory.Redrive(dl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case id := <-deliveries:
+		if id != event.ID() {
+			t.Fatalf("expected redriven event %s but got %s", event.ID(), id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not redriven")
+	}
+}
+
+type retrySub struct {
+	handlerSub
+	policy *chu.RetryPolicy
+}
+
+func (r *retrySub) RetryPolicy() *chu.RetryPolicy {
+	return r.policy
+}
+
+func TestMemoryRetryPolicy(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID: "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	var count int32
+	attempts := make(chan time.Time, 3)
+
+	_, err = memory.Subscribe(&retrySub{
+		handlerSub: handlerSub{
+			topic: "a.b.c",
+			handle: func(event chu.ReceivedEvent) bool {
+				attempts <- time.Now()
+				return atomic.AddInt32(&count, 1) == 3
+			},
+		},
+		policy: &chu.RetryPolicy{
+			MaxAttempts:  3,
+			InitialDelay: 20 * time.Millisecond,
+			Multiplier:   2,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, memory, "a.b.c")
+
+	var times []time.Time
+	for i := 0; i < 3; i++ {
+		select {
+		case at := <-attempts:
+			times = append(times, at)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected 3 attempts but got %d", i)
+		}
+	}
+
+	if d := times[2].Sub(times[1]); d < 40*time.Millisecond {
+		t.Fatalf("expected third attempt to back off at least 40ms but got %s", d)
+	}
+}
+
+func TestMemoryRetryPolicyDeliveries(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID:      "foo",
+		AckTimeout:    200 * time.Millisecond,
+		MaxDeliveries: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	var attempts int32
+	deadLetters := make(chan *broker.DeadLetter, 1)
+
+	_, err = memory.Subscribe(&retrySub{
+		handlerSub: handlerSub{
+			topic: "a.b.c",
+			handle: func(event chu.ReceivedEvent) bool {
+				atomic.AddInt32(&attempts, 1)
+				return false
+			},
+		},
+		policy: &chu.RetryPolicy{
+			MaxAttempts:  3,
+			InitialDelay: 10 * time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = memory.Subscribe(&handlerSub{
+		topic: broker.DeadLetterTopic("a.b.c"),
+		handle: func(event chu.ReceivedEvent) bool {
+			dl := &broker.DeadLetter{}
+			err := event.Message(dl)
+			if err != nil {
+				t.Error(err)
+			}
+
+			deadLetters <- dl
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, memory, "a.b.c")
+
+	select {
+	case dl := <-deadLetters:
+		if dl.Deliveries != 2 {
+			t.Fatalf("expected 2 deliveries but got %d", dl.Deliveries)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not dead-lettered")
+	}
+
+	// each delivery is attempted as many times as the retry policy allows
+	if n := atomic.LoadInt32(&attempts); n != 6 {
+		t.Fatalf("expected 6 attempts but got %d", n)
+	}
+}
+
+type resultSub struct {
+	handlerSub
+	results chan chu.Result
+}
+
+func (r *resultSub) HandleEventResult(event chu.ReceivedEvent) chu.Result {
+	return <-r.results
+}
+
+func TestMemoryResultHandler(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID: "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	results := make(chan chu.Result, 3)
+	results <- chu.Retry(10 * time.Millisecond)
+	results <- chu.Retry(10 * time.Millisecond)
+	results <- chu.DeadLetter("invalid payload")
+
+	_, err = memory.Subscribe(&resultSub{
+		handlerSub: handlerSub{
+			topic: "a.b.c",
+			handle: func(event chu.ReceivedEvent) bool {
+				t.Error("HandleEvent should not be called")
+				return true
+			},
+		},
+		results: results,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadLetters := make(chan *broker.DeadLetter, 1)
+
+	_, err = memory.Subscribe(&handlerSub{
+		topic: broker.DeadLetterTopic("a.b.c"),
+		handle: func(event chu.ReceivedEvent) bool {
+			dl := &broker.DeadLetter{}
+			err := event.Message(dl)
+			if err != nil {
+				t.Error(err)
+			}
+
+			deadLetters <- dl
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := publish(t, memory, "a.b.c")
+
+	select {
+	case dl := <-deadLetters:
+		// retries with a delay are attempts of the same delivery
+		if dl.EventID != event.ID() || dl.Reason != "invalid payload" || dl.Deliveries != 1 {
+			t.Fatalf("unexpected dead letter %+v", dl)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not dead-lettered")
+	}
+}
+
+type contextSub struct {
+	handlerSub
+	handleContext func(ctx context.Context, event chu.ReceivedEvent) chu.Result
+}
+
+func (c *contextSub) HandleEventContext(ctx context.Context, event chu.ReceivedEvent) chu.Result {
+	return c.handleContext(ctx, event)
+}
+
+func TestMemoryContext(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID:   "foo",
+		AckTimeout: 1 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = memory.CreateEventContext(ctx, chu.EventOptions{Topic: "a.b.c"})
+	if err != context.Canceled {
+		t.Fatalf("expected %s but got %v", context.Canceled, err)
+	}
+
+	event := publish(t, memory, "a.b.c")
+
+	err = memory.PublishContext(ctx, event)
+	if err != context.Canceled {
+		t.Fatalf("expected %s but got %v", context.Canceled, err)
+	}
+
+	started := make(chan time.Time, 1)
+	cancelled := make(chan error, 1)
+
+	_, err = memory.Subscribe(&contextSub{
+		handlerSub: handlerSub{
+			topic: "a.b.c",
+		},
+		handleContext: func(ctx context.Context, event chu.ReceivedEvent) chu.Result {
+			deadline, _ := ctx.Deadline()
+			started <- deadline
+
+			<-ctx.Done()
+			cancelled <- ctx.Err()
+			return chu.Ack()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case deadline := <-started:
+		if remaining := time.Until(deadline); remaining <= 0 || remaining > 1*time.Minute {
+			t.Fatalf("expected deadline within ack wait but got %s", remaining)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+
+	memory.Close()
+
+	select {
+	case err := <-cancelled:
+		if err != context.Canceled {
+			t.Fatalf("expected %s but got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("context was not cancelled on close")
+	}
+}
+
+func TestMemoryCausation(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID: "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	followUps := make(chan chu.ReceivedEvent, 1)
+
+	_, err = memory.Subscribe(&handlerSub{
+		topic: "a.b.c",
+		handle: func(event chu.ReceivedEvent) bool {
+			followUp, err := memory.CreateEvent(chu.EventOptions{
+				Topic:    "a.b.c.d",
+				CausedBy: event,
+			})
+			if err != nil {
+				t.Error(err)
+				return false
+			}
+
+			return memory.Publish(followUp) == nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = memory.Subscribe(&handlerSub{
+		topic: "a.b.c.d",
+		handle: func(event chu.ReceivedEvent) bool {
+			followUps <- event
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := publish(t, memory, "a.b.c")
+
+	if event.CorrelationID() != event.ID() || event.CausationID() != "" {
+		t.Fatalf("expected event to start a flow but got correlation %s and causation %s", event.CorrelationID(), event.CausationID())
+	}
+
+	select {
+	case followUp := <-followUps:
+		if followUp.CorrelationID() != event.ID() || followUp.CausationID() != event.ID() {
+			t.Fatalf("expected correlation and causation %s but got %s and %s", event.ID(), followUp.CorrelationID(), followUp.CausationID())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("follow up event was not delivered")
+	}
+}
+
+func TestMemoryTimestamps(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID: "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	events := make(chan chu.ReceivedEvent, 1)
+
+	_, err = memory.Subscribe(&handlerSub{
+		topic: "a.b.c",
+		handle: func(event chu.ReceivedEvent) bool {
+			events <- event
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	occurredAt := before.Add(-1 * time.Hour)
+
+	event, err := memory.CreateEvent(chu.EventOptions{
+		Topic:      "a.b.c",
+		OccurredAt: occurredAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = memory.Publish(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case received := <-events:
+		if !received.OccurredAt().Equal(occurredAt) {
+			t.Fatalf("expected event to occur at %s but got %s", occurredAt, received.OccurredAt())
+		}
+
+		if received.CreatedAt().Before(before) || received.CreatedAt().After(time.Now()) {
+			t.Fatalf("expected event to be created after %s but got %s", before, received.CreatedAt())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+}
+
+func TestMemoryIDGenerator(t *testing.T) {
+	genID := chu.GenID
+	defer func() { chu.GenID = genID }()
+
+	// brokers should not depend on chu.GenID being set
+	chu.GenID = nil
+
+	memory, err := broker.NewMemory(&broker.MemoryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	event, err := memory.CreateEvent(chu.EventOptions{Topic: "a.b.c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event.ID() == "" || event.AggregateID() == "" {
+		t.Fatalf("expected default generator to generate ids but got %+v", event)
+	}
+
+	memory, err = broker.NewMemory(&broker.MemoryOptions{
+		IDGenerator: chu.IDGeneratorFunc(func() string {
+			return "generated"
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	event, err = memory.CreateEvent(chu.EventOptions{Topic: "a.b.c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event.ID() != "generated" || event.AggregateID() != "generated" {
+		t.Fatalf("expected ids to be generated by IDGenerator but got %s and %s", event.ID(), event.AggregateID())
+	}
+
+	event, err = memory.CreateEvent(chu.EventOptions{Topic: "a.b.c", ID: "deterministic"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event.ID() != "deterministic" {
+		t.Fatalf("expected id to be deterministic but got %s", event.ID())
+	}
+}
+
+func TestMemoryIdempotency(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID:    "foo",
+		AckTimeout:  50 * time.Millisecond,
+		Idempotency: unique.New(10),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	var count int32
+	deliveries := make(chan string, 10)
+
+	_, err = memory.Subscribe(&handlerSub{
+		topic: "a.b.c",
+		handle: func(event chu.ReceivedEvent) bool {
+			deliveries <- event.ID()
+			// fail the first delivery
+			return atomic.AddInt32(&count, 1) > 1
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := publish(t, memory, "a.b.c")
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-deliveries:
+		case <-time.After(5 * time.Second):
+			t.Fatal("failed event was not redelivered")
+		}
+	}
+
+	// publishing the processed event again is a duplicate
+	err = memory.Publish(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-deliveries:
+		t.Fatal("duplicate event should not be delivered")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMemoryUniqueMsgChecker(t *testing.T) {
+	checked := make(chan string, 1)
+
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID: "foo",
+		UniqueMsgChecker: func(id string) bool {
+			checked <- id
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	_, err = memory.Subscribe(&handlerSub{
+		topic: "a.b.c",
+		handle: func(event chu.ReceivedEvent) bool {
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := publish(t, memory, "a.b.c")
+
+	select {
+	case id := <-checked:
+		if id != event.ID() {
+			t.Fatalf("expected checker to be given %s but got %s", event.ID(), id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("checker was not called")
+	}
+}
+
+func TestMemoryIdempotencyFanOut(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID:    "foo",
+		Idempotency: unique.New(10),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	deliveries := make(chan string, 10)
+
+	for _, name := range []string{"first", "second"} {
+		name := name
+
+		_, err = memory.Subscribe(&handlerSub{
+			topic: "a.b.c",
+			handle: func(event chu.ReceivedEvent) bool {
+				deliveries <- name
+				return true
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	publish(t, memory, "a.b.c")
+
+	received := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case name := <-deliveries:
+			received[name] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected both subscribers to receive the event but got %v", received)
+		}
+	}
+
+	if !received["first"] || !received["second"] {
+		t.Fatalf("expected both subscribers to receive the event but got %v", received)
+	}
+}
+
+type idempotentSub struct {
+	handlerSub
+	idempotency chu.Idempotency
+}
+
+func (s *idempotentSub) Idempotency() chu.Idempotency {
+	return s.idempotency
+}
+
+func TestMemoryIdempotentSubscriber(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID: "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	deliveries := make(chan string, 10)
+
+	_, err = memory.Subscribe(&idempotentSub{
+		handlerSub: handlerSub{
+			topic: "a.b.c",
+			handle: func(event chu.ReceivedEvent) bool {
+				deliveries <- event.ID()
+				return true
+			},
+		},
+		idempotency: unique.New(10),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := publish(t, memory, "a.b.c")
+
+	select {
+	case <-deliveries:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+
+	err = memory.Publish(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-deliveries:
+		t.Fatal("duplicate event should not be delivered")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMemoryCatchUp(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID: "foo",
+		// long enough to make sure warm-up ends by catching up
+		WarmUpTimeout: 1 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	replayed := publish(t, memory, "a.b.c")
+
+	handled := make(chan string, 10)
+
+	_, err = memory.Subscribe(&handlerSub{
+		topic: "a.b.c",
+		group: "workers",
+		handle: func(event chu.ReceivedEvent) bool {
+			handled <- event.ID()
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caughtUp := make(chan struct{})
+	go func() {
+		memory.Wait()
+		close(caughtUp)
+	}()
+
+	select {
+	case <-caughtUp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected broker to catch up")
+	}
+
+	live := publish(t, memory, "a.b.c")
+
+	select {
+	case id := <-handled:
+		if id == replayed.ID() {
+			t.Fatal("group handler should not handle replayed events during warm-up")
+		}
+
+		if id != live.ID() {
+			t.Fatalf("expected %s but got %s", live.ID(), id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("live event was not handled during warm-up")
+	}
+}
+
+type warmUpSub struct {
+	handlerSub
+	policy chu.WarmUpPolicy
+}
+
+func (s *warmUpSub) WarmUpPolicy() chu.WarmUpPolicy {
+	return s.policy
+}
+
+func TestMemoryWarmUpPolicy(t *testing.T) {
+	testCases := []struct {
+		policy   chu.WarmUpPolicy
+		handled  bool
+		expected broker.WarmUpStats
+	}{
+		{
+			policy:   chu.WarmUpSkip,
+			handled:  false,
+			expected: broker.WarmUpStats{Skipped: 1},
+		},
+		{
+			policy:   chu.WarmUpDefer,
+			handled:  true,
+			expected: broker.WarmUpStats{Deferred: 1},
+		},
+		{
+			policy:   chu.WarmUpProcess,
+			handled:  true,
+			expected: broker.WarmUpStats{Processed: 1},
+		},
+	}
+
+	for _, testCase := range testCases {
+		memory, err := broker.NewMemory(&broker.MemoryOptions{
+			ClientID:      "foo",
+			AckTimeout:    100 * time.Millisecond,
+			WarmUpTimeout: 1 * time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		publish(t, memory, "a.b.c")
+
+		handled := make(chan struct{}, 1)
+
+		_, err = memory.Subscribe(&warmUpSub{
+			handlerSub: handlerSub{
+				topic: "a.b.c",
+				group: "workers",
+				handle: func(event chu.ReceivedEvent) bool {
+					handled <- empty
+					return true
+				},
+			},
+			policy: testCase.policy,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-handled:
+			if !testCase.handled {
+				t.Fatalf("expected policy %d not to handle the replayed event", testCase.policy)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if testCase.handled {
+				t.Fatalf("expected policy %d to handle the replayed event", testCase.policy)
+			}
+		}
+
+		if stats := memory.WarmUpStats(); stats != testCase.expected {
+			t.Fatalf("expected %+v but got %+v", testCase.expected, stats)
+		}
+
+		memory.Close()
+	}
+}
+
+type deferredSub struct {
+	warmUpSub
+	maxInflight int
+}
+
+func (s *deferredSub) MaxInflight() int { return s.maxInflight }
+
+func TestMemoryWarmUpDeferInflight(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID:      "foo",
+		AckTimeout:    50 * time.Millisecond,
+		WarmUpTimeout: 1 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	var events []chu.Event
+	for i := 0; i < 3; i++ {
+		events = append(events, publish(t, memory, "a.b.c"))
+	}
+
+	ids := make(chan string, 10)
+
+	// deferred events fill the in-flight window, so they must not stop the replay
+	sub, err := memory.Subscribe(&deferredSub{
+		warmUpSub: warmUpSub{
+			handlerSub: handlerSub{
+				topic: "a.b.c",
+				handle: func(event chu.ReceivedEvent) bool {
+					ids <- event.ID()
+					return true
+				},
+			},
+			policy: chu.WarmUpDefer,
+		},
+		maxInflight: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, event := range events {
+		select {
+		case id := <-ids:
+			if id != event.ID() {
+				t.Fatalf("expected %s but got %s", event.ID(), id)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected %s to be handled", event.ID())
+		}
+	}
+
+	expected := broker.WarmUpStats{Deferred: 1, Undeferred: 2}
+	if stats := memory.WarmUpStats(); stats != expected {
+		t.Fatalf("expected %+v but got %+v", expected, stats)
+	}
+
+	status := sub.(interface {
+		Status() broker.SubscriptionStatus
+	}).Status()
+
+	if status.Replayed != 3 || !status.CaughtUp {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
+
+func TestMemoryStatus(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID:      "foo",
+		WarmUpTimeout: 1 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	for i := 0; i < 3; i++ {
+		publish(t, memory, "a.b.c")
+	}
+
+	caughtUp := make(chan broker.SubscriptionStatus, 1)
+	memory.OnCaughtUp(func(status broker.SubscriptionStatus) {
+		caughtUp <- status
+	})
+
+	release := make(chan struct{})
+
+	sub, err := memory.Subscribe(&handlerSub{
+		topic: "a.b.c",
+		handle: func(event chu.ReceivedEvent) bool {
+			<-release
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = memory.WaitContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %s but got %v", context.DeadlineExceeded, err)
+	}
+
+	status := sub.(interface {
+		Status() broker.SubscriptionStatus
+	}).Status()
+
+	if !status.Replaying || status.Remaining != 2 {
+		t.Fatalf("expected subscription to be replaying with 2 remaining but got %+v", status)
+	}
+
+	close(release)
+
+	select {
+	case status := <-caughtUp:
+		if status.Topic != "a.b.c" || !status.CaughtUp || status.Replayed != 3 {
+			t.Fatalf("unexpected status %+v", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected subscription to catch up")
+	}
+
+	err = memory.WaitContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if statuses := memory.Subscriptions(); len(statuses) != 1 || !statuses[0].CaughtUp {
+		t.Fatalf("unexpected statuses %+v", statuses)
+	}
+}
+
+func TestMemoryShutdown(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID: "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	var finished int32
+
+	_, err = memory.Subscribe(&handlerSub{
+		topic: "a.b.c",
+		handle: func(event chu.ReceivedEvent) bool {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			atomic.StoreInt32(&finished, 1)
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, memory, "a.b.c")
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = memory.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Fatal("expected shutdown to wait for the running handler")
+	}
+
+	if statuses := memory.Subscriptions(); len(statuses) != 0 {
+		t.Fatalf("expected subscriptions to be closed but got %+v", statuses)
+	}
+}
+
+func TestMemoryShutdownAbandoned(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID: "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+
+	_, err = memory.Subscribe(&contextSub{
+		handlerSub: handlerSub{
+			topic: "a.b.c",
+		},
+		handleContext: func(ctx context.Context, event chu.ReceivedEvent) chu.Result {
+			close(started)
+			<-ctx.Done()
+			return chu.Retry(0)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, memory, "a.b.c")
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = memory.Shutdown(ctx)
+
+	abandoned, ok := err.(*broker.AbandonedError)
+	if !ok {
+		t.Fatalf("expected AbandonedError but got %v", err)
+	}
+
+	if len(abandoned.Abandoned) != 1 || abandoned.Abandoned[0].Topic != "a.b.c" || abandoned.Err != context.DeadlineExceeded {
+		t.Fatalf("unexpected abandoned handlers %+v", abandoned)
+	}
+}
+
+type concurrentSub struct {
+	handlerSub
+	concurrency int
+}
+
+func (s *concurrentSub) Concurrency() int {
+	return s.concurrency
+}
+
+func TestMemoryConcurrency(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID: "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	const perAggregate = 10
+	aggregates := []string{"a", "b", "c", "d"}
+
+	var mtx sync.Mutex
+	var running, maxRunning int32
+	received := make(map[string][]string)
+	done := make(chan struct{}, perAggregate*len(aggregates))
+
+	_, err = memory.Subscribe(&concurrentSub{
+		handlerSub: handlerSub{
+			topic: "a.b.c",
+			handle: func(event chu.ReceivedEvent) bool {
+				current := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+
+				time.Sleep(5 * time.Millisecond)
+
+				mtx.Lock()
+				if current > maxRunning {
+					maxRunning = current
+				}
+				received[event.AggregateID()] = append(received[event.AggregateID()], event.ID())
+				mtx.Unlock()
+
+				done <- empty
+				return true
+			},
+		},
+		concurrency: len(aggregates),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published := make(map[string][]string)
+
+	for i := 0; i < perAggregate; i++ {
+		for _, aggregate := range aggregates {
+			event, err := memory.CreateEvent(chu.EventOptions{
+				Topic:       "a.b.c",
+				AggregateID: aggregate,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = memory.Publish(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			published[aggregate] = append(published[aggregate], event.ID())
+		}
+	}
+
+	for i := 0; i < perAggregate*len(aggregates); i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("not all events were handled")
+		}
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	for _, aggregate := range aggregates {
+		if strings.Join(received[aggregate], ",") != strings.Join(published[aggregate], ",") {
+			t.Fatalf("expected events of %s in order %v but got %v", aggregate, published[aggregate], received[aggregate])
+		}
+	}
+
+	if maxRunning < 2 {
+		t.Fatalf("expected events of different aggregates to be handled in parallel but got %d", maxRunning)
+	}
+}
+
+type deliverySub struct {
+	handlerSub
+	position    chu.StartPosition
+	maxInflight int
+	ackWait     time.Duration
+}
+
+func (s *deliverySub) StartPosition() chu.StartPosition { return s.position }
+func (s *deliverySub) MaxInflight() int                 { return s.maxInflight }
+func (s *deliverySub) AckWait() time.Duration           { return s.ackWait }
+
+func TestMemoryStartPosition(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID: "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	var events []chu.Event
+	for i := 0; i < 3; i++ {
+		events = append(events, publish(t, memory, "a.b.c"))
+	}
+
+	testCases := []struct {
+		position chu.StartPosition
+		expected chu.Event
+	}{
+		{position: chu.StartAll(), expected: events[0]},
+		{position: chu.StartLastReceived(), expected: events[2]},
+		{position: chu.StartAtSequence(2), expected: events[1]},
+		{position: chu.StartAgo(1 * time.Hour), expected: events[0]},
+		{position: chu.StartAtTime(time.Now().Add(1 * time.Hour)), expected: nil},
+		{position: chu.StartNew(), expected: nil},
+	}
+
+	for _, testCase := range testCases {
+		ids := make(chan string, 10)
+
+		sub, err := memory.Subscribe(&deliverySub{
+			handlerSub: handlerSub{
+				topic: "a.b.c",
+				handle: func(event chu.ReceivedEvent) bool {
+					ids <- event.ID()
+					return true
+				},
+			},
+			position: testCase.position,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case id := <-ids:
+			if testCase.expected == nil || id != testCase.expected.ID() {
+				t.Fatalf("unexpected first event %s for position %+v", id, testCase.position)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if testCase.expected != nil {
+				t.Fatalf("expected %s for position %+v", testCase.expected.ID(), testCase.position)
+			}
+		}
+
+		sub.Unsubscribe()
+	}
+}
+
+func TestMemoryMaxInflight(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID: "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	for i := 0; i < 5; i++ {
+		publish(t, memory, "a.b.c")
+	}
+
+	var mtx sync.Mutex
+	var running, maxRunning int
+	done := make(chan struct{}, 5)
+
+	_, err = memory.Subscribe(&concurrentDeliverySub{
+		deliverySub: deliverySub{
+			handlerSub: handlerSub{
+				topic: "a.b.c",
+				handle: func(event chu.ReceivedEvent) bool {
+					mtx.Lock()
+					running++
+					if running > maxRunning {
+						maxRunning = running
+					}
+					mtx.Unlock()
+
+					time.Sleep(10 * time.Millisecond)
+
+					mtx.Lock()
+					running--
+					mtx.Unlock()
+
+					done <- empty
+					return true
+				},
+			},
+			maxInflight: 2,
+			ackWait:     1 * time.Minute,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("not all events were handled")
+		}
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if maxRunning > 2 {
+		t.Fatalf("expected at most 2 events in flight but got %d", maxRunning)
+	}
+}
+
+// concurrentDeliverySub handles every event in its own worker,
+// so only MaxInflight limits the number of events in flight
+type concurrentDeliverySub struct {
+	deliverySub
+}
+
+func (s *concurrentDeliverySub) Concurrency() int { return 5 }
+
+type namedSub struct {
+	handlerSub
+	name string
+}
+
+func (s *namedSub) DurableName() string { return s.name }
+
+func TestMemoryDurableName(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID: "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	event := publish(t, memory, "a.b.c")
+
+	subscribe := func(name string, ids chan string) chu.Subscription {
+		sub, err := memory.Subscribe(&namedSub{
+			handlerSub: handlerSub{
+				topic:   "a.b.c",
+				durable: true,
+				handle: func(event chu.ReceivedEvent) bool {
+					ids <- event.ID()
+					return true
+				},
+			},
+			name: name,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return sub
+	}
+
+	expect := func(ids chan string, expected chu.Event) {
+		select {
+		case id := <-ids:
+			if expected == nil || id != expected.ID() {
+				t.Fatalf("unexpected event %s", id)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if expected != nil {
+				t.Fatalf("expected %s", expected.ID())
+			}
+		}
+	}
+
+	// both durables of the same topic get every event
+	first, second := make(chan string, 10), make(chan string, 10)
+	subscribe("first", first)
+	closed := subscribe("second", second)
+
+	expect(first, event)
+	expect(second, event)
+
+	closed.Close()
+
+	// a closed durable resumes where it left off
+	closed = subscribe("second", second)
+	expect(second, nil)
+
+	closed.Close()
+
+	// a reset durable starts over
+	reset, err := memory.ResetDurable(&namedSub{
+		handlerSub: handlerSub{
+			topic:   "a.b.c",
+			durable: true,
+			handle: func(event chu.ReceivedEvent) bool {
+				second <- event.ID()
+				return true
+			},
+		},
+		name: "second",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect(second, event)
+	expect(first, nil)
+
+	reset.Unsubscribe()
+
+	err = memory.DeleteDurable(&handlerSub{topic: "a.b.c"})
+	if err != broker.ErrNotDurable {
+		t.Fatalf("expected %s but got %v", broker.ErrNotDurable, err)
+	}
+}
+
+type unencodableEvent struct {
+	chu.Event
+}
+
+func TestMemoryPublishAsync(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID:           "foo",
+		MaxPublishInflight: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	ids := make(chan string, 10)
+
+	_, err = memory.Subscribe(&handlerSub{
+		topic: "a.b.c",
+		handle: func(event chu.ReceivedEvent) bool {
+			ids <- event.ID()
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []chu.Event
+	for i := 0; i < 5; i++ {
+		event, err := memory.CreateEvent(chu.EventOptions{
+			Topic: "a.b.c",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		events = append(events, event)
+	}
+
+	ack, err := memory.PublishAsync(context.Background(), events[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ack.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = memory.PublishBatch(context.Background(), events[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, event := range events {
+		select {
+		case id := <-ids:
+			if id != event.ID() {
+				t.Fatalf("expected %s but got %s", event.ID(), id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %s", event.ID())
+		}
+	}
+
+	err = memory.PublishBatch(context.Background(), []chu.Event{
+		events[0],
+		&unencodableEvent{Event: events[1]},
+		events[2],
+	})
+
+	batchErr, ok := err.(*broker.BatchError)
+	if !ok {
+		t.Fatalf("expected BatchError but got %v", err)
+	}
+
+	if batchErr.Errors[0] != nil || batchErr.Errors[1] == nil || batchErr.Errors[2] != nil {
+		t.Fatalf("unexpected errors %v", batchErr.Errors)
+	}
+}
+
+type manualAckSub struct {
+	handlerSub
+}
+
+func (s *manualAckSub) ManualAck() bool { return true }
+
+func TestMemoryManualAck(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID:   "foo",
+		AckTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	events := make(chan chu.ReceivedEvent, 10)
+
+	_, err = memory.Subscribe(&manualAckSub{
+		handlerSub: handlerSub{
+			topic: "a.b.c",
+			handle: func(event chu.ReceivedEvent) bool {
+				events <- event
+				// ignored, the event is acked through its AckHandle
+				return false
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := func(expected chu.Event) chu.AckHandle {
+		select {
+		case event := <-events:
+			if event.ID() != expected.ID() {
+				t.Fatalf("expected %s but got %s", expected.ID(), event.ID())
+			}
+
+			handle, ok := event.(chu.AckHandle)
+			if !ok {
+				t.Fatal("expected event to implement AckHandle")
+			}
+
+			return handle
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %s", expected.ID())
+		}
+
+		return nil
+	}
+
+	// nacked events are redelivered
+	event := publish(t, memory, "a.b.c")
+
+	err = next(event).Nack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// events which are not acked in time are redelivered
+	expired := next(event)
+
+	handle := next(event)
+	if err := expired.Ack(); err != chu.ErrAckExpired {
+		t.Fatalf("expected %s but got %v", chu.ErrAckExpired, err)
+	}
+
+	// events are acked once, after the handler has returned
+	done := make(chan error, 2)
+	go func() {
+		done <- handle.Ack()
+		done <- handle.Ack()
+	}()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != chu.ErrAlreadyAcked {
+		t.Fatalf("expected %s but got %v", chu.ErrAlreadyAcked, err)
+	}
+
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected redelivery of %s", event.ID())
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = memory.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryResetDurableIdempotency(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID:    "foo",
+		Idempotency: unique.New(100),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	event := publish(t, memory, "a.b.c")
+
+	ids := make(chan string, 10)
+
+	sub := &handlerSub{
+		topic:   "a.b.c",
+		durable: true,
+		handle: func(event chu.ReceivedEvent) bool {
+			ids <- event.ID()
+			return true
+		},
+	}
+
+	expect := func(expected chu.Event) {
+		select {
+		case id := <-ids:
+			if expected == nil || id != expected.ID() {
+				t.Fatalf("unexpected event %s", id)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if expected != nil {
+				t.Fatalf("expected %s", expected.ID())
+			}
+		}
+	}
+
+	subscription, err := memory.Subscribe(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect(event)
+
+	// a reset durable handles the events which have been already processed
+	for i := 0; i < 2; i++ {
+		subscription, err = memory.ResetDurable(sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expect(event)
+	}
+
+	// closing and subscribing again resumes in the same scope
+	subscription.Close()
+
+	subscription, err = memory.Subscribe(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect(nil)
+
+	subscription.Unsubscribe()
+}
+
+func TestMemoryResetDurableRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chu-reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "idempotency.db")
+
+	// start runs the broker as a process would, with the same channel
+	// and the same file for its idempotency
+	start := func(events ...chu.Event) (*broker.Memory, *unique.Bolt) {
+		idempotency, err := unique.NewBolt(&unique.BoltOptions{Path: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		memory, err := broker.NewMemory(&broker.MemoryOptions{
+			ClientID:    "foo",
+			Idempotency: idempotency,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, event := range events {
+			err = memory.Publish(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return memory, idempotency
+	}
+
+	ids := make(chan string, 10)
+
+	expect := func(expected ...chu.Event) {
+		for _, event := range expected {
+			select {
+			case id := <-ids:
+				if id != event.ID() {
+					t.Fatalf("expected %s but got %s", event.ID(), id)
+				}
+			case <-time.After(1 * time.Second):
+				t.Fatalf("expected %s", event.ID())
+			}
+		}
+
+		select {
+		case id := <-ids:
+			t.Fatalf("unexpected event %s", id)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	memory, idempotency := start()
+
+	first := publish(t, memory, "a.b.c")
+	second := publish(t, memory, "a.b.c")
+
+	var crashed int32
+
+	sub := &handlerSub{
+		topic:   "a.b.c",
+		durable: true,
+		handle: func(event chu.ReceivedEvent) bool {
+			// the process crashes while the second event is being replayed
+			if atomic.LoadInt32(&crashed) == 1 && event.ID() == second.ID() {
+				return false
+			}
+
+			ids <- event.ID()
+			return true
+		},
+	}
+
+	_, err = memory.Subscribe(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect(first, second)
+
+	atomic.StoreInt32(&crashed, 1)
+
+	_, err = memory.ResetDurable(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect(first)
+
+	memory.Close()
+	idempotency.Close()
+
+	atomic.StoreInt32(&crashed, 0)
+
+	// the durable resumes the replay in the scope of its reset, so
+	// the second event is handled although it was handled before
+	memory, idempotency = start(first, second)
+	defer idempotency.Close()
+	defer memory.Close()
+
+	_, err = memory.Subscribe(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect(second)
+}
+
+func TestMemoryResetDurableOwnIdempotency(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID:    "foo",
+		Idempotency: unique.New(100),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	sub := &idempotentSub{
+		handlerSub: handlerSub{
+			topic:   "a.b.c",
+			durable: true,
+			handle: func(event chu.ReceivedEvent) bool {
+				return true
+			},
+		},
+		idempotency: unique.New(100),
+	}
+
+	subscription, err := memory.Subscribe(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer subscription.Unsubscribe()
+
+	// the broker can't make the subscriber's own idempotency handle replayed events again
+	_, err = memory.ResetDurable(sub)
+	if err != broker.ErrResetIdempotency {
+		t.Fatalf("expected ErrResetIdempotency but got %v", err)
+	}
+
+	if statuses := memory.Subscriptions(); len(statuses) != 1 {
+		t.Fatalf("expected the durable to be left as it is but got %+v", statuses)
+	}
+}
+
+func TestMemoryIdempotencyInProgress(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID:    "foo",
+		AckTimeout:  200 * time.Millisecond,
+		Idempotency: unique.New(100),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	var calls int32
+	handled := make(chan string, 10)
+
+	// the first attempt outlives the ack timeout and fails, so the event is
+	// redelivered to the other member while it's still being handled
+	handle := func(event chu.ReceivedEvent) bool {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(400 * time.Millisecond)
+			return false
+		}
+
+		handled <- event.ID()
+		return true
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = memory.Subscribe(&concurrentSub{
+			handlerSub: handlerSub{
+				topic:  "a.b.c",
+				group:  "workers",
+				handle: handle,
+			},
+			concurrency: 2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	event := publish(t, memory, "a.b.c")
+
+	select {
+	case id := <-handled:
+		if id != event.ID() {
+			t.Fatalf("expected %s but got %s", event.ID(), id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the failed event to be handled again, handler was called %d times", atomic.LoadInt32(&calls))
+	}
+}
+
+func TestMemoryAckWaitRounding(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID: "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	var count int32
+	deliveries := make(chan time.Time, 2)
+
+	// ack wait is rounded up to a second, as NATS streaming does
+	_, err = memory.Subscribe(&deliverySub{
+		handlerSub: handlerSub{
+			topic: "a.b.c",
+			handle: func(event chu.ReceivedEvent) bool {
+				deliveries <- time.Now()
+				return atomic.AddInt32(&count, 1) == 2
+			},
+		},
+		ackWait: 300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, memory, "a.b.c")
+
+	var times []time.Time
+	for i := 0; i < 2; i++ {
+		select {
+		case at := <-deliveries:
+			times = append(times, at)
+		case <-time.After(5 * time.Second):
+			t.Fatal("event was not redelivered")
+		}
+	}
+
+	if d := times[1].Sub(times[0]); d < 900*time.Millisecond {
+		t.Fatalf("expected redelivery after a second but got %s", d)
+	}
+}
+
+func TestMemoryWarmUpDeferRedelivery(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID:      "foo",
+		AckTimeout:    1 * time.Hour,
+		WarmUpTimeout: 1 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	var events []chu.Event
+	for i := 0; i < 2; i++ {
+		events = append(events, publish(t, memory, "a.b.c"))
+	}
+
+	ids := make(chan string, 10)
+
+	// deferred events are redelivered once the subscription
+	// catches up, rather than once their ack wait expires
+	_, err = memory.Subscribe(&warmUpSub{
+		handlerSub: handlerSub{
+			topic: "a.b.c",
+			handle: func(event chu.ReceivedEvent) bool {
+				ids <- event.ID()
+				return true
+			},
+		},
+		policy: chu.WarmUpDefer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(map[string]bool)
+	for range events {
+		select {
+		case id := <-ids:
+			handled[id] = true
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected deferred events to be redelivered")
+		}
+	}
+
+	for _, event := range events {
+		if !handled[event.ID()] {
+			t.Fatalf("expected %s to be handled", event.ID())
+		}
+	}
+
+	expected := broker.WarmUpStats{Deferred: 2}
+	if stats := memory.WarmUpStats(); stats != expected {
+		t.Fatalf("expected %+v but got %+v", expected, stats)
+	}
+}
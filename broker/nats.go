@@ -1,9 +1,12 @@
 package broker
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	gonats "github.com/nats-io/go-nats"
@@ -14,22 +17,57 @@ import (
 	"github.com/nulloop/chu/v2/heartbeat"
 )
 
-var _ chu.Event = &NatsEvent{}
+var _ chu.ReceivedEvent = &NatsEvent{}
 var _ chu.Broker = &Nats{}
+var _ chu.Subscription = &natsSubscription{}
 
 type NatsEvent struct {
-	id          string
-	aggregateID string
-	body        []byte
-	topic       string
-	createdAt   time.Time
-	codec       []chu.Codec
+	id            string
+	aggregateID   string
+	body          []byte
+	headers       map[string]string
+	correlationID string
+	causationID   string
+	topic         string
+	createdAt     time.Time
+	occurredAt    time.Time
+	codec         []chu.Codec
+	version       int
 }
 
 func (evt *NatsEvent) ID() string           { return evt.id }
 func (evt *NatsEvent) AggregateID() string  { return evt.aggregateID }
 func (evt *NatsEvent) Topic() string        { return evt.topic }
 func (evt *NatsEvent) CreatedAt() time.Time { return evt.createdAt }
+func (evt *NatsEvent) CausationID() string  { return evt.causationID }
+
+func (evt *NatsEvent) OccurredAt() time.Time {
+	if evt.occurredAt.IsZero() {
+		return evt.createdAt
+	}
+
+	return evt.occurredAt
+}
+
+// CorrelationID falls back to event's id for events
+// which are published by older publishers
+func (evt *NatsEvent) CorrelationID() string {
+	if evt.correlationID == "" {
+		return evt.id
+	}
+
+	return evt.correlationID
+}
+
+// Headers is never nil. Its map is made once the event is created or decoded,
+// as events might be shared between goroutines
+func (evt *NatsEvent) Headers() map[string]string {
+	if evt.headers == nil {
+		return map[string]string{}
+	}
+
+	return evt.headers
+}
 
 func (evt *NatsEvent) Message(msg chu.Message) error {
 	if evt.body == nil || len(evt.body) == 0 {
@@ -52,148 +90,273 @@ func (evt *NatsEvent) Message(msg chu.Message) error {
 }
 
 func (evt *NatsEvent) EvtEncode() ([]byte, error) {
-	var err error
-
-	// only need to serialize id, aggregate and byte
-	size := len(evt.id) + 8
-	size += len(evt.aggregateID) + 8
-	size += len(evt.body) + 8
-
-	bin := binary.NewEncoding(size)
+	switch evt.version {
+	case EnvelopeV2:
+		return encodeV2(evt)
+	case EnvelopeV3:
+		return encodeV3(evt, EnvelopeV3)
+	case 0, EnvelopeV4:
+		return encodeV3(evt, EnvelopeV4)
+	default:
+		return nil, ErrUnsupportedEnvelope
+	}
+}
 
-	err = bin.EncodeString(evt.id)
+func (evt *NatsEvent) EvtDecode(data []byte) error {
+	err := evt.decode(data)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	err = bin.EncodeString(evt.aggregateID)
-	if err != nil {
-		return nil, err
+	if evt.headers == nil {
+		evt.headers = make(map[string]string)
 	}
 
-	err = bin.EncodeBytes(evt.body)
-	if err != nil {
-		return nil, err
+	return nil
+}
+
+func (evt *NatsEvent) decode(data []byte) error {
+	// envelopes without magic bytes are produced by v2 publishers
+	if !bytes.HasPrefix(data, envelopeMagic) {
+		evt.version = EnvelopeV2
+		return decodeV2(evt, data)
+	}
+
+	if len(data) <= len(envelopeMagic) {
+		return binary.ErrShortBuffer
 	}
 
-	return bin.Bytes(), nil
+	evt.version = int(data[len(envelopeMagic)])
+
+	switch evt.version {
+	case EnvelopeV3, EnvelopeV4:
+		return decodeV3(evt, data)
+	default:
+		return ErrUnsupportedEnvelope
+	}
 }
 
-func (evt *NatsEvent) EvtDecode(data []byte) error {
+// newEvent creates an event which its message is encoded by given codec
+func (d *dispatcher) newEvent(eventOpts chu.EventOptions, codec []chu.Codec) (*NatsEvent, error) {
+	if eventOpts.Topic == "" {
+		return nil, errors.New("topic is required")
+	}
+
+	id := eventOpts.ID
+	if id == "" {
+		id = d.idGenerator.NewID()
+	}
+
+	aggregateID := eventOpts.AggregateID
+
+	if aggregateID == "" {
+		aggregateID = d.idGenerator.NewID()
+	}
+
+	var body []byte
 	var err error
 
-	bin := binary.NewDecoding(data)
+	if eventOpts.Message != nil {
+		for _, c := range codec {
+			err := c.Encode(eventOpts.Message)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		body, err = eventOpts.Message.MsgEncode()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		body = make([]byte, 0)
+	}
 
-	evt.id, err = bin.DecodeString()
-	if err != nil {
-		return err
+	headers := make(map[string]string, len(eventOpts.Headers))
+	for key, value := range eventOpts.Headers {
+		headers[key] = value
 	}
 
-	evt.aggregateID, err = bin.DecodeString()
-	if err != nil {
-		return err
+	correlationID := id
+	causationID := ""
+
+	occurredAt := eventOpts.OccurredAt
+	if occurredAt.IsZero() {
+		occurredAt = time.Now()
 	}
 
-	evt.body, err = bin.DecodeBytes()
-	if err != nil {
-		return err
+	if eventOpts.CausedBy != nil {
+		correlationID = eventOpts.CausedBy.CorrelationID()
+		causationID = eventOpts.CausedBy.ID()
 	}
 
-	return nil
+	if eventOpts.CorrelationID != "" {
+		correlationID = eventOpts.CorrelationID
+	}
+
+	if eventOpts.CausationID != "" {
+		causationID = eventOpts.CausationID
+	}
+
+	return &NatsEvent{
+		id:            id,
+		aggregateID:   aggregateID,
+		body:          body,
+		headers:       headers,
+		correlationID: correlationID,
+		causationID:   causationID,
+		occurredAt:    occurredAt,
+		topic:         eventOpts.Topic,
+		codec:         codec,
+		version:       d.envelopeVersion,
+	}, nil
+}
+
+// lastSequenceTimeout is how long lastSequence waits for the last message of a
+// channel. An empty channel can't be told apart from a slow server, so if it
+// doesn't arrive in time the warm-up timeout decides when the subscription has
+// caught up
+const lastSequenceTimeout = 1 * time.Second
+
+type natsSubscription struct {
+	stan.Subscription
+	broker *Nats
+	sub    *subscriber
+}
+
+func (s *natsSubscription) Unsubscribe() error {
+	s.broker.unregister(s.sub)
+	s.sub.stop()
+	return s.Subscription.Unsubscribe()
+}
+
+func (s *natsSubscription) Close() error {
+	s.broker.unregister(s.sub)
+	s.sub.stop()
+	return s.Subscription.Close()
+}
+
+// Status reports the progress of the subscription replaying its channel
+func (s *natsSubscription) Status() SubscriptionStatus {
+	return s.sub.status()
 }
 
 type Nats struct {
-	name             string
-	ackTimeout       time.Duration
-	wait             func()
-	tick             func()
-	done             func() <-chan struct{}
-	uniqueMsgChecker func(id string) bool
-	conn             stan.Conn
-	codec            []chu.Codec
+	dispatcher
+	nc   *gonats.Conn
+	conn stan.Conn
+	mtx  sync.Mutex
+	lost error
 }
 
 func (n *Nats) Publish(event chu.Event) error {
-	v, ok := event.(chu.EventEncoder)
-	if !ok {
-		return errors.New("event is not EventEncoder type")
-	}
+	return n.PublishContext(context.Background(), event)
+}
 
-	data, err := v.EvtEncode()
+func (n *Nats) PublishContext(ctx context.Context, event chu.Event) error {
+	data, err := encodeEvent(event)
 	if err != nil {
 		return err
 	}
 
-	return n.conn.Publish(event.Topic(), data)
+	return n.publish(ctx, event.Topic(), data)
 }
 
-func (n *Nats) durableName(topic string) string {
-	return fmt.Sprintf("%s.%s", n.name, topic)
+// deleteIdleDurable deletes a durable which has no open subscriptions in this
+// process. Durable queue groups are only deleted once their members in other
+// processes have unsubscribed too.
+func (n *Nats) deleteIdleDurable(sub chu.Subscriber, name string) error {
+	// a durable can only be deleted by unsubscribing it, so it's opened without
+	// acking anything which might be redelivered in the meantime
+	options := []stan.SubscriptionOption{
+		stan.DurableName(name),
+		stan.SetManualAckMode(),
+		stan.MaxInflight(1),
+	}
+
+	ignore := func(*stan.Msg) {}
+
+	var subscription stan.Subscription
+	var err error
+
+	if sub.Group() != "" {
+		subscription, err = n.conn.QueueSubscribe(sub.Topic(), sub.Group(), ignore, options...)
+	} else {
+		subscription, err = n.conn.Subscribe(sub.Topic(), ignore, options...)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return subscription.Unsubscribe()
 }
 
 func (n *Nats) Subscribe(sub chu.Subscriber) (chu.Subscription, error) {
 	var err error
 
+	durableName := n.durableName(sub)
+
+	s := n.newSubscriber(sub, n.scope(sub, durableName))
+	s.durableName = durableName
+
 	options := []stan.SubscriptionOption{
 		stan.SetManualAckMode(),
-		stan.DeliverAllAvailable(),
+		startOption(s.startPosition()),
 	}
 
 	if sub.Durable() {
-		options = append(options, stan.DurableName(n.durableName(sub.Topic())))
+		options = append(options, stan.DurableName(durableName))
+	}
+
+	if s.ackWait != stan.DefaultAckWait {
+		options = append(options, stan.AckWait(s.ackWait))
 	}
 
-	if n.ackTimeout > 0 {
-		options = append(options, stan.AckWait(n.ackTimeout))
+	if maxInflight := s.maxInflight(); maxInflight > 0 {
+		options = append(options, stan.MaxInflight(maxInflight))
 	}
 
 	group := sub.Group()
 	isGroupHandler := group != ""
 
-	handler := func(msg *stan.Msg) {
-		n.tick()
+	// probed is closed once the last sequence of the channel is looked up
+	probed := make(chan struct{})
 
-		// this `select` is a necessary logic to prevent calling
-		// queue handler during warm-up time. Queue handler should not be called
-		// as they are design to generate more events or talk to external services
-		// generating events are prohabited during warm-up time.
-		select {
-		case <-n.done():
-			// ignore
-		default:
-			// default will be called because we are still in
-			// warmup time and we want to make sure that if handler is a group handler
-			// it should not be executed.
-			if isGroupHandler {
-				msg.Ack()
-				return
-			}
-		}
+	if s.startPosition().Position == chu.PositionNew {
+		// subscriptions starting with new messages have nothing to replay
+		s.setTarget(0)
+		close(probed)
+	} else {
+		// the last sequence is fixed before subscribing, so messages
+		// which are published in the meantime are not taken as replayed
+		wait := n.lastSequence(sub.Topic())
 
-		event := &NatsEvent{
-			codec: n.codec,
-		}
+		go func() {
+			defer close(probed)
 
-		// extract id, aggregate id and bytes from message
-		err := event.EvtDecode(msg.Data)
-		if err != nil {
-			// Log the error here
-			msg.Ack()
-			return
-		}
+			last, ok := wait()
+			if ok {
+				s.setTarget(last)
+			}
+		}()
+	}
 
-		if !n.uniqueMsgChecker(event.id) {
-			msg.Ack()
-			return
+	handler := func(msg *stan.Msg) {
+		// messages can't be told apart from replayed
+		// ones until the last sequence is looked up
+		select {
+		case <-probed:
+		case <-n.ctx.Done():
 		}
 
-		event.topic = sub.Topic()
-		event.createdAt = time.Unix(msg.Timestamp, 0)
-		event.codec = n.codec
-
-		if sub.HandleEvent(event) {
-			msg.Ack()
-		}
+		n.dispatch(s, &delivery{
+			data:        msg.Data,
+			sequence:    msg.Sequence,
+			timestamp:   msg.Timestamp,
+			redelivered: msg.Redelivered,
+			ack:         msg.Ack,
+		})
 	}
 
 	var subscription stan.Subscription
@@ -205,82 +368,219 @@ func (n *Nats) Subscribe(sub chu.Subscriber) (chu.Subscription, error) {
 	}
 
 	if err != nil {
+		s.stop()
 		return nil, err
 	}
 
-	return subscription, nil
-}
+	natsSub := &natsSubscription{
+		Subscription: subscription,
+		broker:       n,
+		sub:          s,
+	}
 
-func (n *Nats) CreateEvent(eventOpts chu.EventOptions) (chu.Event, error) {
-	if eventOpts.Topic == "" {
-		return nil, errors.New("topic is required")
+	n.register(s, natsSub)
+
+	if s.isCaughtUp() {
+		go n.caughtUp(s)
 	}
 
-	id := chu.GenID()
-	aggregateID := eventOpts.AggregateID
+	return natsSub, nil
+}
 
-	if aggregateID == "" {
-		aggregateID = chu.GenID()
+// startOption translates position into the option of stan
+func startOption(position chu.StartPosition) stan.SubscriptionOption {
+	switch position.Position {
+	case chu.PositionNew:
+		// stan starts with new messages if no start option is given
+		return func(*stan.SubscriptionOptions) error { return nil }
+	case chu.PositionLastReceived:
+		return stan.StartWithLastReceived()
+	case chu.PositionSequence:
+		return stan.StartAtSequence(position.Sequence)
+	case chu.PositionTime:
+		return stan.StartAtTime(position.Time)
+	case chu.PositionAgo:
+		return stan.StartAtTimeDelta(position.Ago)
+	default:
+		return stan.DeliverAllAvailable()
 	}
+}
 
-	var body []byte
-	var err error
+// lastSequence subscribes to the last message of given topic, which is fixed once
+// the subscription is made, and returns a func waiting for its sequence. The func
+// returns false if the sequence is not known in time
+func (n *Nats) lastSequence(topic string) func() (uint64, bool) {
+	last := make(chan uint64, 1)
 
-	if eventOpts.Message != nil {
-		for _, c := range n.codec {
-			err := c.Encode(eventOpts.Message)
-			if err != nil {
-				return nil, err
-			}
+	subscription, err := n.conn.Subscribe(topic, func(msg *stan.Msg) {
+		select {
+		case last <- msg.Sequence:
+		default:
 		}
+	}, stan.StartWithLastReceived())
+	if err != nil {
+		return func() (uint64, bool) { return 0, false }
+	}
 
-		body, err = eventOpts.Message.MsgEncode()
-		if err != nil {
-			return nil, err
+	return func() (uint64, bool) {
+		defer subscription.Unsubscribe()
+
+		select {
+		case seq := <-last:
+			return seq, true
+		case <-time.After(lastSequenceTimeout):
+			return 0, false
+		case <-n.ctx.Done():
+			return 0, false
 		}
-	} else {
-		body = make([]byte, 0)
 	}
+}
 
-	return &NatsEvent{
-		id:          id,
-		aggregateID: aggregateID,
-		body:        body,
-		topic:       eventOpts.Topic,
-		codec:       n.codec,
-	}, nil
+func (n *Nats) CreateEvent(eventOpts chu.EventOptions) (chu.Event, error) {
+	return n.CreateEventContext(context.Background(), eventOpts)
+}
+
+func (n *Nats) CreateEventContext(ctx context.Context, eventOpts chu.EventOptions) (chu.Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	event, err := n.newEvent(eventOpts, n.codec)
+	if err != nil {
+		return nil, err
+	}
+
+	return event, nil
 }
 
 func (n *Nats) Wait() error {
-	n.wait()
-	return nil
+	return n.WaitContext(context.Background())
 }
 
 func (n *Nats) Close() error {
+	n.cancel()
+	n.stopWorkers()
 	return n.conn.Close()
 }
 
+var connectionStates = map[gonats.Status]string{
+	gonats.DISCONNECTED:  "DISCONNECTED",
+	gonats.CONNECTED:     "CONNECTED",
+	gonats.CLOSED:        "CLOSED",
+	gonats.RECONNECTING:  "RECONNECTING",
+	gonats.CONNECTING:    "CONNECTING",
+	gonats.DRAINING_SUBS: "DRAINING_SUBS",
+	gonats.DRAINING_PUBS: "DRAINING_PUBS",
+}
+
+// Health reports the state of the connection, the streaming session and subscriptions
+func (n *Nats) Health() Health {
+	health := n.health()
+	health.Connection = connectionStates[n.nc.Status()]
+	health.Session = n.ctx.Err() == nil
+
+	n.mtx.Lock()
+	if n.lost != nil {
+		health.Session = false
+		health.SessionError = n.lost.Error()
+	}
+	n.mtx.Unlock()
+
+	return health
+}
+
+func (n *Nats) connectionLost(_ stan.Conn, err error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	n.lost = err
+}
+
 type NatsOptions struct {
-	ClientID         string
-	ClusterID        string
-	Addr             string
-	Codec            []chu.Codec
-	TLS              *tls.Config
-	AckTimeout       time.Duration
-	WarmUpTimeout    time.Duration
-	UniqueMsgChecker func(id string) bool // Enable Idempotence
+	ClientID   string
+	ClusterID  string
+	Addr       string
+	Codec      []chu.Codec
+	TLS        *tls.Config
+	AckTimeout time.Duration // defaults to stan.DefaultAckWait, rounded up to whole seconds
+	// WarmUpTimeout ends warm-up if no message is received for it, even if some
+	// subscriptions have not caught up with the last sequence of their channel.
+	// Durable subscriptions which have nothing left to replay rely on it
+	WarmUpTimeout time.Duration
+	// Idempotency makes sure each event is processed once by each subscriber.
+	// Subscribers implementing chu.IdempotentSubscriber use their own one
+	Idempotency chu.Idempotency
+	// Deprecated: use Idempotency. It marks events as processed even if
+	// their handlers fail, and it's shared by every subscriber, so an event
+	// is handled by only one subscriber of its topic. Ignored if Idempotency is set
+	UniqueMsgChecker func(id string) bool
+	// MaxDeliveries is the number of failed deliveries after which an event is published
+	// to the dead-letter topic and acked. Attempts of a subscriber's RetryPolicy count as
+	// one delivery. Zero disables dead-lettering
+	MaxDeliveries int
+	// DeadLetterTopic defaults to DeadLetterTopic(topic) of the failing subscription
+	DeadLetterTopic string
+	// EnvelopeVersion defaults to EnvelopeLatest. Set it to EnvelopeV2 while
+	// there are still consumers running chu v2
+	EnvelopeVersion int
+	// IDGenerator defaults to chu.GenID if it is set, otherwise to idgen.XID
+	IDGenerator chu.IDGenerator
+	// MaxPublishInflight is the number of published events which may wait for their ack.
+	// PublishAsync blocks while it's reached. Defaults to stan.DefaultMaxPubAcksInflight
+	MaxPublishInflight int
 }
 
 func NewNats(opt *NatsOptions) (*Nats, error) {
 	broker := &Nats{
-		name:             fmt.Sprintf("%s.%s", opt.ClusterID, opt.ClientID),
-		ackTimeout:       opt.AckTimeout,
-		uniqueMsgChecker: opt.UniqueMsgChecker,
-		codec:            opt.Codec,
+		dispatcher: dispatcher{
+			ackTimeout:      opt.AckTimeout,
+			idempotency:     newIdempotency(opt.Idempotency, opt.UniqueMsgChecker),
+			codec:           opt.Codec,
+			maxDeliveries:   opt.MaxDeliveries,
+			deadLetterTopic: opt.DeadLetterTopic,
+			envelopeVersion: opt.EnvelopeVersion,
+			idGenerator:     opt.IDGenerator,
+			name:            fmt.Sprintf("%s.%s", opt.ClusterID, opt.ClientID),
+			maxInflight:     stan.DefaultMaxInflight,
+			subscribers:     make(map[*subscriber]chu.Subscription),
+			changed:         make(chan struct{}),
+			inflight:        make(map[*InFlight]struct{}),
+			landed:          make(chan struct{}),
+		},
+	}
+
+	if !validEnvelope(broker.envelopeVersion) {
+		return nil, ErrUnsupportedEnvelope
+	}
+
+	if broker.idGenerator == nil {
+		broker.idGenerator = defaultIDGenerator{}
+	}
+
+	if broker.ackTimeout <= 0 {
+		broker.ackTimeout = stan.DefaultAckWait
 	}
 
-	if broker.uniqueMsgChecker == nil {
-		broker.uniqueMsgChecker = func(_ string) bool { return true }
+	broker.ackTimeout = roundAckWait(broker.ackTimeout)
+
+	broker.ctx, broker.cancel = context.WithCancel(context.Background())
+
+	broker.closer = broker.Close
+	broker.subscribe = broker.Subscribe
+	broker.deleteDurable = broker.deleteIdleDurable
+
+	maxPublishInflight := opt.MaxPublishInflight
+	if maxPublishInflight <= 0 {
+		maxPublishInflight = stan.DefaultMaxPubAcksInflight
+	}
+
+	broker.window = make(chan struct{}, maxPublishInflight)
+	broker.publish = broker.sendWait
+	broker.send = func(topic string, data []byte, done func(err error)) error {
+		_, err := broker.conn.PublishAsync(topic, data, func(_ string, err error) {
+			done(err)
+		})
+		return err
 	}
 
 	natsOpts := make([]gonats.Option, 0)
@@ -293,8 +593,16 @@ func NewNats(opt *NatsOptions) (*Nats, error) {
 		return nil, err
 	}
 
+	broker.nc = nc
+
 	for {
-		broker.conn, err = stan.Connect(opt.ClusterID, opt.ClientID, stan.NatsConn(nc))
+		broker.conn, err = stan.Connect(
+			opt.ClusterID,
+			opt.ClientID,
+			stan.NatsConn(nc),
+			stan.MaxPubAcksInflight(maxPublishInflight),
+			stan.SetConnectionLostHandler(broker.connectionLost),
+		)
 		if err != nil {
 			if err == stan.ErrConnectReqTimeout {
 				time.Sleep(1 * time.Second)
@@ -306,7 +614,9 @@ func NewNats(opt *NatsOptions) (*Nats, error) {
 		break
 	}
 
-	broker.wait, broker.tick, broker.done = heartbeat.New(opt.WarmUpTimeout)
+	_, broker.tick, broker.done = heartbeat.New(opt.WarmUpTimeout)
+
+	go broker.finishWarmUp()
 
 	return broker, nil
 }
@@ -1,6 +1,7 @@
 package broker_test
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"testing"
@@ -13,6 +14,7 @@ import (
 	"github.com/nulloop/chu/v2"
 	"github.com/nulloop/chu/v2/binary"
 	"github.com/nulloop/chu/v2/broker"
+	"github.com/nulloop/chu/v2/unique"
 )
 
 const (
@@ -250,3 +252,402 @@ func TestBroker2(t *testing.T) {
 
 	time.Sleep(1 * time.Second)
 }
+
+func TestNatsDeadLetter(t *testing.T) {
+	nats, err := broker.NewNats(&broker.NatsOptions{
+		Addr:          gonats.DefaultURL,
+		ClusterID:     clusterName,
+		ClientID:      "deadletter",
+		AckTimeout:    1 * time.Second,
+		MaxDeliveries: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer nats.Close()
+
+	deliveries := make(chan string, 3)
+	deadLetters := make(chan *broker.DeadLetter, 1)
+
+	sub, err := nats.Subscribe(&handlerSub{
+		topic: "dead.letter.test",
+		handle: func(event chu.ReceivedEvent) bool {
+			deliveries <- event.ID()
+			return false
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	dlSub, err := nats.Subscribe(&handlerSub{
+		topic: broker.DeadLetterTopic("dead.letter.test"),
+		handle: func(event chu.ReceivedEvent) bool {
+			dl := &broker.DeadLetter{}
+			err := event.Message(dl)
+			if err != nil {
+				t.Error(err)
+			}
+
+			deadLetters <- dl
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dlSub.Unsubscribe()
+
+	event := publish(t, nats, "dead.letter.test")
+
+	select {
+	case dl := <-deadLetters:
+		if dl.EventID != event.ID() || dl.Deliveries != 2 {
+			t.Fatalf("unexpected dead letter %+v", dl)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("event was not dead-lettered")
+	}
+
+	if len(deliveries) != 2 {
+		t.Fatalf("expected 2 deliveries but got %d", len(deliveries))
+	}
+}
+
+func TestNatsCatchUp(t *testing.T) {
+	nats, err := broker.NewNats(&broker.NatsOptions{
+		Addr:          gonats.DefaultURL,
+		ClusterID:     clusterName,
+		ClientID:      "catchup",
+		WarmUpTimeout: 1 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer nats.Close()
+
+	for i := 0; i < 3; i++ {
+		publish(t, nats, "catch.up.test")
+	}
+
+	sub, err := nats.Subscribe(&handlerSub{
+		topic: "catch.up.test",
+		handle: func(event chu.ReceivedEvent) bool {
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	caughtUp := make(chan struct{})
+	go func() {
+		nats.Wait()
+		close(caughtUp)
+	}()
+
+	select {
+	case <-caughtUp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected broker to catch up")
+	}
+}
+
+func TestNatsCatchUpLive(t *testing.T) {
+	nats, err := broker.NewNats(&broker.NatsOptions{
+		Addr:          gonats.DefaultURL,
+		ClusterID:     clusterName,
+		ClientID:      "catchuplive",
+		WarmUpTimeout: 1 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer nats.Close()
+
+	for i := 0; i < 2; i++ {
+		publish(t, nats, "catch.up.live.test")
+	}
+
+	ids := make(chan string, 3)
+
+	// group handlers skip replayed events while warming up
+	sub, err := nats.Subscribe(&handlerSub{
+		topic: "catch.up.live.test",
+		group: "live",
+		handle: func(event chu.ReceivedEvent) bool {
+			ids <- event.ID()
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	live := publish(t, nats, "catch.up.live.test")
+
+	select {
+	case id := <-ids:
+		if id != live.ID() {
+			t.Fatalf("expected live event %s but got %s", live.ID(), id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("live event was not handled")
+	}
+}
+
+func TestNatsStartPosition(t *testing.T) {
+	nats, err := broker.NewNats(&broker.NatsOptions{
+		Addr:      gonats.DefaultURL,
+		ClusterID: clusterName,
+		ClientID:  "position",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer nats.Close()
+
+	publish(t, nats, "start.position.test")
+
+	ids := make(chan string, 2)
+
+	sub, err := nats.Subscribe(&deliverySub{
+		handlerSub: handlerSub{
+			topic: "start.position.test",
+			handle: func(event chu.ReceivedEvent) bool {
+				ids <- event.ID()
+				return true
+			},
+		},
+		position: chu.StartNew(),
+		ackWait:  5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	event := publish(t, nats, "start.position.test")
+
+	select {
+	case id := <-ids:
+		if id != event.ID() {
+			t.Fatalf("expected subscription to start with %s but got %s", event.ID(), id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("new event was not delivered")
+	}
+}
+
+func TestNatsPublishBatch(t *testing.T) {
+	nats, err := broker.NewNats(&broker.NatsOptions{
+		Addr:               gonats.DefaultURL,
+		ClusterID:          clusterName,
+		ClientID:           "batch",
+		MaxPublishInflight: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer nats.Close()
+
+	ids := make(chan string, 20)
+
+	sub, err := nats.Subscribe(&deliverySub{
+		handlerSub: handlerSub{
+			topic: "publish.batch.test",
+			handle: func(event chu.ReceivedEvent) bool {
+				ids <- event.ID()
+				return true
+			},
+		},
+		position: chu.StartNew(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	var events []chu.Event
+	for i := 0; i < 20; i++ {
+		event, err := nats.CreateEvent(chu.EventOptions{
+			Topic: "publish.batch.test",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		events = append(events, event)
+	}
+
+	err = nats.PublishBatch(context.Background(), events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, event := range events {
+		select {
+		case id := <-ids:
+			if id != event.ID() {
+				t.Fatalf("expected %s but got %s", event.ID(), id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %s", event.ID())
+		}
+	}
+}
+
+func TestNatsShutdown(t *testing.T) {
+	nats, err := broker.NewNats(&broker.NatsOptions{
+		Addr:      gonats.DefaultURL,
+		ClusterID: clusterName,
+		ClientID:  "shutdown",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	finished := make(chan struct{})
+
+	_, err = nats.Subscribe(&deliverySub{
+		handlerSub: handlerSub{
+			topic: "shutdown.test",
+			handle: func(event chu.ReceivedEvent) bool {
+				close(started)
+				time.Sleep(100 * time.Millisecond)
+				close(finished)
+				return true
+			},
+		},
+		position: chu.StartNew(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, nats, "shutdown.test")
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = nats.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-finished:
+	default:
+		t.Fatal("expected shutdown to wait for the running handler")
+	}
+
+	if statuses := nats.Subscriptions(); len(statuses) != 0 {
+		t.Fatalf("expected subscriptions to be closed but got %+v", statuses)
+	}
+
+	// the broker is closed once its handlers have finished
+	event, err := nats.CreateEvent(chu.EventOptions{
+		Topic: "shutdown.test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if nats.Publish(event) == nil {
+		t.Fatal("expected publishing to fail once the broker is shut down")
+	}
+}
+
+func TestNatsResetDurable(t *testing.T) {
+	nats, err := broker.NewNats(&broker.NatsOptions{
+		Addr:        gonats.DefaultURL,
+		ClusterID:   clusterName,
+		ClientID:    "reset",
+		Idempotency: unique.New(100),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer nats.Close()
+
+	testCases := []struct {
+		topic string
+		group string
+	}{
+		{topic: "reset.durable.test"},
+		{topic: "reset.group.test", group: "workers"},
+	}
+
+	for _, testCase := range testCases {
+		ids := make(chan string, 10)
+
+		// replayed events of groups are skipped by default
+		sub := &warmUpSub{
+			handlerSub: handlerSub{
+				topic:   testCase.topic,
+				durable: true,
+				group:   testCase.group,
+				handle: func(event chu.ReceivedEvent) bool {
+					ids <- event.ID()
+					return true
+				},
+			},
+			policy: chu.WarmUpProcess,
+		}
+
+		expect := func(event chu.Event) {
+			select {
+			case id := <-ids:
+				if id != event.ID() {
+					t.Fatalf("expected %s but got %s", event.ID(), id)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected %s on %s", event.ID(), testCase.topic)
+			}
+		}
+
+		event := publish(t, nats, testCase.topic)
+
+		subscription, err := nats.Subscribe(sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expect(event)
+
+		// the durable has no open subscription, so it's deleted
+		// by subscribing to it and unsubscribing right away
+		err = subscription.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		subscription, err = nats.ResetDurable(sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expect(event)
+
+		err = subscription.Unsubscribe()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/nulloop/chu/v2"
+)
+
+// PublishAck is returned by PublishAsync. Done is closed once the broker has
+// acked the event or given up on it
+type PublishAck struct {
+	Event chu.Event
+	done  chan struct{}
+	err   error
+}
+
+func (a *PublishAck) Done() <-chan struct{} {
+	return a.done
+}
+
+// Err returns the error of the publish once Done is closed, and nil before
+func (a *PublishAck) Err() error {
+	select {
+	case <-a.done:
+		return a.err
+	default:
+		return nil
+	}
+}
+
+// Wait waits for the ack of the event and returns its error, or ctx's error if ctx is
+// done first. The event might still reach the broker if ctx is done after it has been sent.
+func (a *PublishAck) Wait(ctx context.Context) error {
+	select {
+	case <-a.done:
+		return a.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *PublishAck) resolve(err error) {
+	a.err = err
+	close(a.done)
+}
+
+// BatchError is returned by PublishBatch if some of the events failed. Errors has
+// an entry for each event of the batch, which is nil for the published ones.
+type BatchError struct {
+	Errors []error
+}
+
+func (e *BatchError) Error() string {
+	failed := 0
+	for _, err := range e.Errors {
+		if err != nil {
+			failed++
+		}
+	}
+
+	return fmt.Sprintf("publish batch: %d of %d events failed", failed, len(e.Errors))
+}
+
+func encodeEvent(event chu.Event) ([]byte, error) {
+	v, ok := event.(chu.EventEncoder)
+	if !ok {
+		return nil, errors.New("event is not EventEncoder type")
+	}
+
+	return v.EvtEncode()
+}
+
+// sendAsync takes a slot of the publish window, which blocks while the window is
+// full, and sends data to topic. The slot is freed once the ack is received
+func (d *dispatcher) sendAsync(ctx context.Context, topic string, data []byte, event chu.Event) (*PublishAck, error) {
+	select {
+	case d.window <- empty:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	ack := &PublishAck{
+		Event: event,
+		done:  make(chan struct{}),
+	}
+
+	err := d.send(topic, data, func(err error) {
+		<-d.window
+		ack.resolve(err)
+	})
+	if err != nil {
+		<-d.window
+		return nil, err
+	}
+
+	return ack, nil
+}
+
+// sendWait sends data to topic and waits for its ack
+func (d *dispatcher) sendWait(ctx context.Context, topic string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ack, err := d.sendAsync(ctx, topic, data, nil)
+	if err != nil {
+		return err
+	}
+
+	return ack.Wait(ctx)
+}
+
+// PublishAsync publishes event without waiting for its ack. It blocks while too many
+// events are waiting for their ack, and returns ctx's error if ctx is done first.
+func (d *dispatcher) PublishAsync(ctx context.Context, event chu.Event) (*PublishAck, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	data, err := encodeEvent(event)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.sendAsync(ctx, event.Topic(), data, event)
+}
+
+// PublishBatch publishes events without waiting for each other's ack, then waits for
+// all of them. Events of the same topic are published in order. It returns *BatchError
+// if any of the events fails.
+func (d *dispatcher) PublishBatch(ctx context.Context, events []chu.Event) error {
+	acks := make([]*PublishAck, len(events))
+	errs := make([]error, len(events))
+
+	for i, event := range events {
+		acks[i], errs[i] = d.PublishAsync(ctx, event)
+	}
+
+	failed := false
+	for i, ack := range acks {
+		if ack != nil {
+			errs[i] = ack.Wait(ctx)
+		}
+
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+
+	if failed {
+		return &BatchError{Errors: errs}
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nulloop/chu/v2"
+)
+
+// InFlight describes a message which is being handled
+type InFlight struct {
+	Topic    string
+	Group    string
+	Sequence uint64
+	Since    time.Time
+}
+
+// AbandonedError is returned by Shutdown if its context is done before
+// every handler has finished. Messages of abandoned handlers are not acked
+// and are redelivered after the ack timeout.
+type AbandonedError struct {
+	Err       error
+	Abandoned []InFlight
+}
+
+func (e *AbandonedError) Error() string {
+	return fmt.Sprintf("shutdown: %s, %d handlers abandoned", e.Err, len(e.Abandoned))
+}
+
+// begin records given message as in-flight and returns false if the broker is
+// draining, in which case the message is left unacked to be redelivered
+func (d *dispatcher) begin(sub *subscriber, msg *delivery) (*InFlight, bool) {
+	d.flightMtx.Lock()
+	defer d.flightMtx.Unlock()
+
+	if d.draining {
+		return nil, false
+	}
+
+	inflight := &InFlight{
+		Topic:    sub.Topic(),
+		Group:    sub.Group(),
+		Sequence: msg.sequence,
+		Since:    time.Now(),
+	}
+
+	d.inflight[inflight] = empty
+	return inflight, true
+}
+
+func (d *dispatcher) end(inflight *InFlight) {
+	d.flightMtx.Lock()
+	defer d.flightMtx.Unlock()
+
+	delete(d.inflight, inflight)
+
+	close(d.landed)
+	d.landed = make(chan struct{})
+}
+
+// land waits for the running handlers to finish
+func (d *dispatcher) land(ctx context.Context) error {
+	for {
+		d.flightMtx.Lock()
+
+		landed := d.landed
+		abandoned := make([]InFlight, 0, len(d.inflight))
+		for inflight := range d.inflight {
+			abandoned = append(abandoned, *inflight)
+		}
+
+		d.flightMtx.Unlock()
+
+		if len(abandoned) == 0 {
+			return nil
+		}
+
+		select {
+		case <-landed:
+		case <-ctx.Done():
+			return &AbandonedError{
+				Err:       ctx.Err(),
+				Abandoned: abandoned,
+			}
+		}
+	}
+}
+
+// drain stops handing messages to subscribers and waits for the running
+// handlers to finish, then closes every subscription
+func (d *dispatcher) drain(ctx context.Context) error {
+	d.flightMtx.Lock()
+	d.draining = true
+	d.flightMtx.Unlock()
+
+	err := d.land(ctx)
+
+	// handlers which are still running are told to give up
+	d.cancel()
+
+	d.subsMtx.Lock()
+	subscriptions := make([]chu.Subscription, 0, len(d.subscribers))
+	for _, subscription := range d.subscribers {
+		subscriptions = append(subscriptions, subscription)
+	}
+	d.subsMtx.Unlock()
+
+	// durable subscriptions are closed rather than unsubscribed,
+	// so they resume from where they left off
+	for _, subscription := range subscriptions {
+		closeErr := subscription.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// Shutdown stops handing messages to subscribers, waits for running handlers
+// to finish and closes subscriptions before closing the broker. If ctx is done
+// first, it returns an *AbandonedError describing the handlers still running.
+// Events of a chu.ManualAckSubscriber are running until they are acked or nacked.
+func (d *dispatcher) Shutdown(ctx context.Context) error {
+	err := d.drain(ctx)
+
+	closeErr := d.closer()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
@@ -0,0 +1,325 @@
+package broker
+
+import (
+	"context"
+	"time"
+
+	"github.com/nulloop/chu/v2"
+)
+
+// SubscriptionStatus reports the progress of a subscription
+// replaying the messages which were published before it was made
+type SubscriptionStatus struct {
+	Topic   string
+	Group   string
+	Durable bool
+	// Replaying is true until the subscription has caught up
+	Replaying bool
+	// CaughtUp is true once the subscription has received the last message which
+	// was published before it was made, or once the warm-up timeout has passed
+	CaughtUp bool
+	// Replayed is the number of received messages which were published
+	// before the subscription was made
+	Replayed uint64
+	// Remaining is the estimated number of messages left to replay. It's zero
+	// until the last sequence of the channel is known
+	Remaining uint64
+	// Target is the last sequence of the channel at subscribe time
+	Target uint64
+	// Last is the highest sequence received so far
+	Last uint64
+	// LastMessageAt is the time the last message was received at
+	LastMessageAt time.Time
+}
+
+// Health reports the state of a broker. See package health
+// for serving it over http
+type Health struct {
+	// Connection is the state of the connection to the server, i.e. CONNECTED
+	Connection string
+	// Session is false once the streaming session has been lost or the broker
+	// has been closed. The broker has to be created again to recover
+	Session bool
+	// SessionError is the reason the session has been lost
+	SessionError string
+	// WarmingUp is true until every subscription has caught up
+	WarmingUp     bool
+	Subscriptions []SubscriptionStatus
+	// LastMessageAt is the time the last message was received by any subscription
+	LastMessageAt time.Time
+}
+
+// replayed records the sequence of a delivered message and returns true if
+// the message had been published before the subscription was made. Until target
+// is known every message is considered replayed. caughtUp is true if this message
+// is the one which made the subscriber catch up.
+func (s *subscriber) replayed(seq uint64) (replayed bool, caughtUp bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// redeliveries have been already counted
+	first := seq > s.last
+	if first {
+		s.last = seq
+	}
+
+	s.lastAt = time.Now()
+
+	if s.caughtUp {
+		return false, false
+	}
+
+	replayed = !s.known || seq <= s.target
+	if replayed && first {
+		s.replays++
+	}
+
+	s.caughtUp = s.known && seq >= s.target
+	return replayed, s.caughtUp
+}
+
+// setTarget sets the last sequence of the channel at subscribe time, zero
+// means there is nothing to replay. It returns true if the subscriber has
+// already received target.
+func (s *subscriber) setTarget(target uint64) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.known {
+		return false
+	}
+
+	s.target = target
+	s.known = true
+	s.caughtUp = s.last >= target
+
+	return s.caughtUp
+}
+
+// finishWarmUp marks the subscriber as caught up once the warm-up timeout has
+// passed. It returns true if the subscriber had not caught up yet.
+func (s *subscriber) finishWarmUp() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.caughtUp {
+		return false
+	}
+
+	s.caughtUp = true
+	return true
+}
+
+func (s *subscriber) isCaughtUp() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.caughtUp
+}
+
+func (s *subscriber) status() SubscriptionStatus {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	status := SubscriptionStatus{
+		Topic:     s.Topic(),
+		Group:     s.Group(),
+		Durable:   s.Durable(),
+		Replaying: !s.caughtUp,
+		CaughtUp:  s.caughtUp,
+		Replayed:  s.replays,
+		Target:    s.target,
+		Last:      s.last,
+
+		LastMessageAt: s.lastAt,
+	}
+
+	if s.known && !s.caughtUp && s.target > s.last {
+		status.Remaining = s.target - s.last
+	}
+
+	return status
+}
+
+// register adds given subscriber to the ones Wait waits for
+func (d *dispatcher) register(sub *subscriber, subscription chu.Subscription) {
+	d.subsMtx.Lock()
+	defer d.subsMtx.Unlock()
+
+	d.subscribers[sub] = subscription
+	d.notify()
+}
+
+func (d *dispatcher) unregister(sub *subscriber) {
+	d.subsMtx.Lock()
+	defer d.subsMtx.Unlock()
+
+	delete(d.subscribers, sub)
+	d.notify()
+}
+
+// durableSubscriptions returns the open subscriptions of the durable of given subscriber
+func (d *dispatcher) durableSubscriptions(sub chu.Subscriber, name string) []chu.Subscription {
+	d.subsMtx.Lock()
+	defer d.subsMtx.Unlock()
+
+	var subscriptions []chu.Subscription
+	for s, subscription := range d.subscribers {
+		if s.Durable() && s.durableName == name && s.Topic() == sub.Topic() && s.Group() == sub.Group() {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+
+	return subscriptions
+}
+
+// notify wakes up WaitContext. subsMtx must be held
+func (d *dispatcher) notify() {
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// caughtUp wakes up WaitContext and calls OnCaughtUp
+// callbacks once given subscriber has caught up
+func (d *dispatcher) caughtUp(sub *subscriber) {
+	d.release(sub)
+
+	d.subsMtx.Lock()
+	d.notify()
+	announced := sub.announced
+	sub.announced = true
+	callbacks := d.onCaughtUp
+	d.subsMtx.Unlock()
+
+	if announced {
+		return
+	}
+
+	status := sub.status()
+	for _, fn := range callbacks {
+		fn(status)
+	}
+}
+
+// finishWarmUp marks every subscriber which is still replaying
+// as caught up once the warm-up timeout has passed
+func (d *dispatcher) finishWarmUp() {
+	select {
+	case <-d.done():
+	case <-d.ctx.Done():
+		return
+	}
+
+	for _, sub := range d.registered() {
+		if sub.finishWarmUp() {
+			d.caughtUp(sub)
+		}
+	}
+}
+
+func (d *dispatcher) registered() []*subscriber {
+	d.subsMtx.Lock()
+	defer d.subsMtx.Unlock()
+
+	subs := make([]*subscriber, 0, len(d.subscribers))
+	for sub := range d.subscribers {
+		subs = append(subs, sub)
+	}
+
+	return subs
+}
+
+// Subscriptions returns the status of every open subscription
+func (d *dispatcher) Subscriptions() []SubscriptionStatus {
+	subs := d.registered()
+
+	statuses := make([]SubscriptionStatus, 0, len(subs))
+	for _, sub := range subs {
+		statuses = append(statuses, sub.status())
+	}
+
+	return statuses
+}
+
+// OnCaughtUp registers fn to be called once each subscription has caught up. It's
+// called right away for subscriptions which have already caught up. fn is called
+// from the goroutine delivering messages, so it must not block.
+func (d *dispatcher) OnCaughtUp(fn func(status SubscriptionStatus)) {
+	d.subsMtx.Lock()
+
+	d.onCaughtUp = append(d.onCaughtUp, fn)
+
+	// the ones which are not announced yet are going to call fn themselves
+	var statuses []SubscriptionStatus
+	for sub := range d.subscribers {
+		if sub.announced {
+			statuses = append(statuses, sub.status())
+		}
+	}
+
+	d.subsMtx.Unlock()
+
+	for _, status := range statuses {
+		fn(status)
+	}
+}
+
+// warmedUp returns true if every open subscription has caught up with
+// its channel. changed is closed once it's worth asking again
+func (d *dispatcher) warmedUp() (warmedUp bool, changed <-chan struct{}) {
+	d.subsMtx.Lock()
+	defer d.subsMtx.Unlock()
+
+	warmedUp = len(d.subscribers) > 0
+	for sub := range d.subscribers {
+		if !sub.isCaughtUp() {
+			warmedUp = false
+			break
+		}
+	}
+
+	return warmedUp, d.changed
+}
+
+// health fills in the parts of Health which are shared by all brokers
+func (d *dispatcher) health() Health {
+	health := Health{
+		Subscriptions: d.Subscriptions(),
+	}
+
+	warmedUp, _ := d.warmedUp()
+
+	select {
+	case <-d.done():
+	default:
+		health.WarmingUp = !warmedUp
+	}
+
+	for _, status := range health.Subscriptions {
+		if status.LastMessageAt.After(health.LastMessageAt) {
+			health.LastMessageAt = status.LastMessageAt
+		}
+	}
+
+	return health
+}
+
+// WaitContext blocks until every open subscription has caught up with its channel,
+// or no message has been received for the warm-up timeout. It returns ctx's error
+// if ctx is done first.
+func (d *dispatcher) WaitContext(ctx context.Context) error {
+	for {
+		warmedUp, changed := d.warmedUp()
+		if warmedUp {
+			return nil
+		}
+
+		select {
+		case <-d.done():
+			return nil
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// workerQueueSize is the number of events which can wait for each
+// worker before the delivery of messages is blocked
+const workerQueueSize = 16
+
+type job struct {
+	run func()
+	// drop is called instead of run if workers are stopped before the job runs
+	drop func()
+}
+
+// workers runs jobs in a fixed number of goroutines. Jobs with the same
+// key always run in the same goroutine, in the order they are submitted.
+type workers struct {
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	queues  [][]job
+	stopped bool
+}
+
+func (w *workers) run(i int) {
+	for {
+		w.mtx.Lock()
+
+		for len(w.queues[i]) == 0 && !w.stopped {
+			w.cond.Wait()
+		}
+
+		if w.stopped {
+			dropped := w.queues[i]
+			w.queues[i] = nil
+			w.mtx.Unlock()
+
+			for _, job := range dropped {
+				job.drop()
+			}
+
+			return
+		}
+
+		job := w.queues[i][0]
+		w.queues[i] = w.queues[i][1:]
+
+		// there is room for blocked submits
+		w.cond.Broadcast()
+		w.mtx.Unlock()
+
+		job.run()
+	}
+}
+
+// submit queues a job to the worker of given key. It blocks while the queue is
+// full and returns false if the workers have been stopped, in which case the
+// job is neither run nor dropped.
+func (w *workers) submit(key string, run func(), drop func()) bool {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	i := hash.Sum32() % uint32(len(w.queues))
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	for len(w.queues[i]) >= workerQueueSize && !w.stopped {
+		w.cond.Wait()
+	}
+
+	if w.stopped {
+		return false
+	}
+
+	w.queues[i] = append(w.queues[i], job{run: run, drop: drop})
+	w.cond.Broadcast()
+
+	return true
+}
+
+// stop makes workers exit once their current job is done. Queued jobs are dropped
+// and their messages are redelivered as they have not been acked.
+func (w *workers) stop() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.stopped = true
+	w.cond.Broadcast()
+}
+
+func newWorkers(size int) *workers {
+	w := &workers{
+		queues: make([][]job, size),
+	}
+
+	w.cond = sync.NewCond(&w.mtx)
+
+	for i := range w.queues {
+		go w.run(i)
+	}
+
+	return w
+}
+
+// stopWorkers stops the workers of every subscription once the broker is closed
+func (d *dispatcher) stopWorkers() {
+	for _, sub := range d.registered() {
+		sub.stop()
+	}
+}
@@ -3,18 +3,40 @@
 package chu
 
 import (
+	"context"
 	"errors"
+	"math"
+	"math/rand"
 	"time"
 )
 
 var (
+	// Deprecated: brokers fall back to a default IDGenerator when GenID is not set
 	ErrGenIDNotDefined = errors.New("GenID function not defined")
+	// ErrAlreadyAcked is returned by AckHandle if the event has been acked or nacked before
+	ErrAlreadyAcked = errors.New("event has already been acked or nacked")
+	// ErrAckExpired is returned by AckHandle if the event has been nacked by the broker
+	// as its ack wait was about to expire, or the broker has been closed
+	ErrAckExpired = errors.New("ack wait of event has expired")
 )
 
-// GenID needs to be set prior to use this library
-// It basically generates ID and AggregateID
+// GenID generates ID and AggregateID of events when no IDGenerator is set in broker's options
+//
+// Deprecated: set IDGenerator in broker's options instead
 var GenID func() string
 
+// IDGenerator generates ID and AggregateID of events
+type IDGenerator interface {
+	NewID() string
+}
+
+// IDGeneratorFunc is an adapter to allow the use of ordinary functions as IDGenerator
+type IDGeneratorFunc func() string
+
+func (f IDGeneratorFunc) NewID() string {
+	return f()
+}
+
 // Message is a base for data which is being sent by user
 type Message interface {
 	MsgEncode() ([]byte, error)
@@ -30,11 +52,24 @@ type Event interface {
 	ID() string
 	AggregateID() string
 	Topic() string
+	// CorrelationID is shared by all events of a flow. It is the ID of
+	// the event which started the flow
+	CorrelationID() string
+	// CausationID is the ID of the event which caused this event. It is empty
+	// for the event which started the flow
+	CausationID() string
 }
 
 type ReceivedEvent interface {
 	Event
+	// CreatedAt is the time the broker has received the event
 	CreatedAt() time.Time
+	// OccurredAt is the time the event has been created by its producer. It falls back
+	// to CreatedAt for events which don't carry it
+	OccurredAt() time.Time
+	// Headers returns the metadata attached to event through EventOptions.Headers.
+	// It is never nil
+	Headers() map[string]string
 	// Message will be used parse the message from body of event
 	Message(ptr Message) error
 }
@@ -61,15 +96,254 @@ type Subscriber interface {
 	HandleEvent(event ReceivedEvent) bool
 }
 
+// Action tells the broker what to do with an event after it has been handled
+type Action int
+
+const (
+	// ActionAck acks the event
+	ActionAck Action = iota
+	// ActionRetry retries the event after Result.Delay, zero delay falls back to
+	// the subscriber's RetryPolicy or the broker's redelivery
+	ActionRetry
+	// ActionDeadLetter publishes the event to the dead-letter topic with Result.Reason
+	// and acks it
+	ActionDeadLetter
+	// ActionSkip acks the event without treating it as processed
+	ActionSkip
+)
+
+// Result is returned by ResultHandler to tell the broker the outcome of handling an event
+type Result struct {
+	Action Action
+	Delay  time.Duration
+	Reason string
+}
+
+func Ack() Result {
+	return Result{Action: ActionAck}
+}
+
+func Retry(delay time.Duration) Result {
+	return Result{Action: ActionRetry, Delay: delay}
+}
+
+func DeadLetter(reason string) Result {
+	return Result{Action: ActionDeadLetter, Reason: reason}
+}
+
+func Skip() Result {
+	return Result{Action: ActionSkip}
+}
+
+// ResultHandler can be implemented by a Subscriber which needs to tell the broker
+// whether a failure is permanent or transient. If implemented, HandleEventResult is
+// called instead of HandleEvent.
+type ResultHandler interface {
+	HandleEventResult(event ReceivedEvent) Result
+}
+
+// ContextHandler can be implemented by a Subscriber which needs a context while handling
+// events. The context is cancelled when the broker is closed or when the ack wait of the
+// event is about to expire. If implemented, HandleEventContext is called instead of
+// HandleEventResult and HandleEvent.
+type ContextHandler interface {
+	HandleEventContext(ctx context.Context, event ReceivedEvent) Result
+}
+
+// RetryPolicy describes how a failed event is retried by the broker before
+// falling back to redelivery after the ack timeout
+type RetryPolicy struct {
+	MaxAttempts  int           // number of attempts per delivery, including the first one
+	InitialDelay time.Duration // delay before the second attempt
+	Multiplier   float64       // growth of delay per attempt, values below 1 means constant delay
+	Jitter       float64       // fraction of delay which is randomly added or subtracted, between 0 and 1
+	MaxDelay     time.Duration // optional
+}
+
+// Delay returns how long the broker has to wait after the given failed attempt
+func (p *RetryPolicy) Delay(attempt int) time.Duration {
+	multiplier := math.Max(p.Multiplier, 1)
+	delay := float64(p.InitialDelay) * math.Pow(multiplier, float64(attempt-1))
+
+	if p.MaxDelay > 0 {
+		delay = math.Min(delay, float64(p.MaxDelay))
+	}
+
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(delay)
+}
+
+// Retrier can be implemented by a Subscriber to retry failed
+// events with backoff instead of waiting for the ack timeout
+type Retrier interface {
+	RetryPolicy() *RetryPolicy
+}
+
+// AckHandle is implemented by events received by a ManualAckSubscriber. Only the
+// first call of Ack or Nack takes effect, the others return ErrAlreadyAcked.
+type AckHandle interface {
+	// Ack marks the event as processed
+	Ack() error
+	// Nack leaves the event to be redelivered after the ack wait
+	Nack() error
+}
+
+// ManualAckSubscriber can be implemented by a Subscriber which acks its events after its
+// handler has returned, i.e. from another goroutine or once a batch has been processed.
+// If ManualAck returns true, events implement AckHandle and the result of the handler is
+// ignored. Events which are not acked before their ack wait is about to expire are nacked.
+type ManualAckSubscriber interface {
+	ManualAck() bool
+}
+
+// Idempotency makes sure an event is processed only once. Brokers reserve the id of
+// an event before handing it to the subscriber, then commit it once the event has
+// been processed, or release it so a redelivery of the event gets processed again.
+type Idempotency interface {
+	// Reserve returns false if id has been already committed or reserved
+	Reserve(id string) bool
+	Commit(id string)
+	Release(id string)
+	// Committed returns true if id has been committed. Brokers use it to tell a
+	// duplicate, which is acked, from an event which is still being handled, which
+	// is left to be redelivered in case its handler fails
+	Committed(id string) bool
+}
+
+// NamedSubscriber can be implemented by a durable Subscriber to choose its durable name
+// instead of the one derived from the broker's client id and its topic. It allows more
+// than one durable subscriber of a topic in one client.
+type NamedSubscriber interface {
+	DurableName() string
+}
+
+// IdempotentSubscriber can be implemented by a Subscriber to deduplicate
+// its events with its own Idempotency instead of the broker's one
+type IdempotentSubscriber interface {
+	Idempotency() Idempotency
+}
+
+// WarmUpPolicy tells the broker what to do with events which were published before
+// a subscription was made, while the broker is warming up
+type WarmUpPolicy int
+
+const (
+	// WarmUpSkip acks events without handling them. It's the default of group handlers
+	// as they are meant to generate more events or talk to external services
+	WarmUpSkip WarmUpPolicy = iota
+	// WarmUpDefer leaves events unacked, so they are handled once they are redelivered
+	// after the subscription has caught up. Memory redelivers them right away, NATS
+	// streaming once their AckWait expires. Once deferred events fill the in-flight
+	// window of the subscription, the replay could not go on, so the rest of the
+	// replayed events are handled right away as with WarmUpProcess
+	WarmUpDefer
+	// WarmUpProcess handles events right away. It's the default of other handlers
+	WarmUpProcess
+)
+
+// WarmUpSubscriber can be implemented by a Subscriber to override its default WarmUpPolicy
+type WarmUpSubscriber interface {
+	WarmUpPolicy() WarmUpPolicy
+}
+
+// ConcurrentSubscriber can be implemented by a Subscriber to handle events with
+// Concurrency workers. Events are assigned to workers by their AggregateID, so events
+// of the same aggregate are still handled one at a time and in order.
+type ConcurrentSubscriber interface {
+	Concurrency() int
+}
+
+// Position is where a new subscription starts to receive messages of its channel
+type Position int
+
+const (
+	// PositionAll starts with the first message of the channel
+	PositionAll Position = iota
+	// PositionNew starts with the messages published after the subscription is made
+	PositionNew
+	// PositionLastReceived starts with the last message of the channel
+	PositionLastReceived
+	// PositionSequence starts with the message at StartPosition.Sequence
+	PositionSequence
+	// PositionTime starts with the first message published at or after StartPosition.Time
+	PositionTime
+	// PositionAgo starts with the first message published at most StartPosition.Ago ago
+	PositionAgo
+)
+
+// StartPosition is where a new subscription starts. Durable subscriptions only
+// use it when they are made for the first time, afterwards they resume from
+// where they left off
+type StartPosition struct {
+	Position Position
+	Sequence uint64
+	Time     time.Time
+	Ago      time.Duration
+}
+
+func StartAll() StartPosition {
+	return StartPosition{Position: PositionAll}
+}
+
+func StartNew() StartPosition {
+	return StartPosition{Position: PositionNew}
+}
+
+func StartLastReceived() StartPosition {
+	return StartPosition{Position: PositionLastReceived}
+}
+
+func StartAtSequence(sequence uint64) StartPosition {
+	return StartPosition{Position: PositionSequence, Sequence: sequence}
+}
+
+func StartAtTime(t time.Time) StartPosition {
+	return StartPosition{Position: PositionTime, Time: t}
+}
+
+func StartAgo(ago time.Duration) StartPosition {
+	return StartPosition{Position: PositionAgo, Ago: ago}
+}
+
+// PositionedSubscriber can be implemented by a Subscriber to start somewhere
+// other than the first message of its channel
+type PositionedSubscriber interface {
+	StartPosition() StartPosition
+}
+
+// MaxInflightSubscriber can be implemented by a Subscriber to limit the number
+// of messages which are delivered to it but have not been acked yet
+type MaxInflightSubscriber interface {
+	MaxInflight() int
+}
+
+// AckWaitSubscriber can be implemented by a Subscriber to override the broker's
+// AckTimeout. It's rounded up to whole seconds, as NATS streaming counts ack wait
+// in seconds. Handlers are given a little less than AckWait to finish
+type AckWaitSubscriber interface {
+	AckWait() time.Duration
+}
+
 type Subscription interface {
 	Unsubscribe() error
 	Close() error
 }
 
 type EventOptions struct {
-	AggregateID string  // optional
-	Topic       string  // required
-	Message     Message // optional
+	ID          string            // optional, set it to publish idempotently
+	AggregateID string            // optional
+	Topic       string            // required
+	Message     Message           // optional
+	Headers     map[string]string // optional, i.e. content type, schema version, tenant or trace information
+	// CausedBy is optional. It should be set to the received event which is being handled
+	// so the created event's CausationID becomes its ID and its CorrelationID is inherited.
+	CausedBy      Event
+	CorrelationID string    // optional, overrides the one inherited from CausedBy
+	CausationID   string    // optional, overrides the one inherited from CausedBy
+	OccurredAt    time.Time // optional, defaults to the time event is created
 }
 
 type Broker interface {
@@ -78,9 +352,15 @@ type Broker interface {
 	// internall it calls EvtEncode to convert event to bytes and publish
 	// that bytes to topic.
 	Publish(event Event) error
+	// PublishContext is the same as Publish but returns as soon as ctx is done.
+	// The event might still reach the broker if ctx is done after it has been sent.
+	PublishContext(ctx context.Context, event Event) error
 	// Internally, CreateEvent will call Message.MsgEncode to encode given message to
 	// bytes and saves that to internal variable
 	CreateEvent(eventOpts EventOptions) (Event, error)
+	CreateEventContext(ctx context.Context, eventOpts EventOptions) (Event, error)
 	Wait() error
+	// WaitContext is the same as Wait but returns ctx's error if ctx is done first
+	WaitContext(ctx context.Context) error
 	Close() error
 }
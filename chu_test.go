@@ -0,0 +1,40 @@
+package chu_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nulloop/chu/v2"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := &chu.RetryPolicy{
+		InitialDelay: 100 * time.Millisecond,
+		Multiplier:   2,
+		MaxDelay:     1 * time.Second,
+	}
+
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		1 * time.Second,
+		1 * time.Second,
+	}
+
+	for i, delay := range expected {
+		if result := policy.Delay(i + 1); result != delay {
+			t.Fatalf("expected attempt %d to be delayed %s but got %s", i+1, delay, result)
+		}
+	}
+
+	policy.Jitter = 0.5
+
+	for i := 0; i < 100; i++ {
+		result := policy.Delay(1)
+		if result < 50*time.Millisecond || result > 150*time.Millisecond {
+			t.Fatalf("expected jittered delay to be between 50ms and 150ms but got %s", result)
+		}
+	}
+}
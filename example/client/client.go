@@ -7,10 +7,9 @@ import (
 	"io/ioutil"
 	"time"
 
-	"github.com/rs/xid"
-
 	"github.com/nulloop/chu/v2"
 	"github.com/nulloop/chu/v2/broker"
+	"github.com/nulloop/chu/v2/idgen"
 )
 
 type Security struct {
@@ -75,10 +74,6 @@ func (s *Sub) HandleEvent(event chu.ReceivedEvent) bool {
 }
 
 func main() {
-	chu.GenID = func() string {
-		return xid.New().String()
-	}
-
 	security := &Security{}
 
 	err := security.Certificate("./etc/service.crt", "./etc/service.key")
@@ -92,10 +87,11 @@ func main() {
 	}
 
 	broker, err := broker.NewNats(&broker.NatsOptions{
-		Addr:      "nats://127.0.0.1:4222",
-		ClientID:  "client5",
-		ClusterID: "sample",
-		TLS:       security.ClientTLS(""),
+		Addr:        "nats://127.0.0.1:4222",
+		ClientID:    "client5",
+		ClusterID:   "sample",
+		TLS:         security.ClientTLS(""),
+		IDGenerator: idgen.XID{},
 	})
 	if err != nil {
 		panic(err)
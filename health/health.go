@@ -0,0 +1,152 @@
+// Package health serves the health of a broker over http, so orchestrators
+// can probe liveness and readiness of services
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nulloop/chu/v2/broker"
+)
+
+var _ Reporter = &broker.Nats{}
+var _ Reporter = &broker.Memory{}
+var _ http.Handler = &Handler{}
+
+// Reporter is implemented by brokers of package broker
+type Reporter interface {
+	Health() broker.Health
+}
+
+// Subscription is the status of a subscription in Report
+type Subscription struct {
+	Topic         string     `json:"topic"`
+	Group         string     `json:"group,omitempty"`
+	Durable       bool       `json:"durable"`
+	CaughtUp      bool       `json:"caughtUp"`
+	Replayed      uint64     `json:"replayed"`
+	Remaining     uint64     `json:"remaining"`
+	LastMessageAt *time.Time `json:"lastMessageAt,omitempty"`
+}
+
+// Report is the body of every response of Handler
+type Report struct {
+	// Live is false once the broker has lost its session or its connection is closed.
+	// It stays true while the connection is reconnecting, so a restart of the NATS
+	// server doesn't get every service restarted
+	Live bool `json:"live"`
+	// Ready is true once the broker is live and connected, and required
+	// subscriptions have caught up
+	Ready         bool           `json:"ready"`
+	Connection    string         `json:"connection"`
+	Session       bool           `json:"session"`
+	SessionError  string         `json:"sessionError,omitempty"`
+	WarmingUp     bool           `json:"warmingUp"`
+	Subscriptions []Subscription `json:"subscriptions"`
+	LastMessageAt *time.Time     `json:"lastMessageAt,omitempty"`
+}
+
+// Handler serves Report as json. Requests to paths ending with "/live" are answered
+// with 503 Service Unavailable if the broker is not live, all the others if it's
+// not ready.
+type Handler struct {
+	reporter Reporter
+	topics   map[string]struct{}
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+// Report collects the health of the broker
+func (h *Handler) Report() *Report {
+	health := h.reporter.Health()
+
+	report := &Report{
+		Live:          health.Session && health.Connection != "CLOSED",
+		Connection:    health.Connection,
+		Session:       health.Session,
+		SessionError:  health.SessionError,
+		WarmingUp:     health.WarmingUp,
+		Subscriptions: make([]Subscription, 0, len(health.Subscriptions)),
+		LastMessageAt: timeOrNil(health.LastMessageAt),
+	}
+
+	// without required topics, every subscription is required
+	caughtUp := len(h.topics) > 0 || !health.WarmingUp
+	required := make(map[string]bool)
+
+	for _, status := range health.Subscriptions {
+		report.Subscriptions = append(report.Subscriptions, Subscription{
+			Topic:         status.Topic,
+			Group:         status.Group,
+			Durable:       status.Durable,
+			CaughtUp:      status.CaughtUp,
+			Replayed:      status.Replayed,
+			Remaining:     status.Remaining,
+			LastMessageAt: timeOrNil(status.LastMessageAt),
+		})
+
+		if _, ok := h.topics[status.Topic]; ok {
+			required[status.Topic] = required[status.Topic] || status.CaughtUp
+		}
+	}
+
+	for topic := range h.topics {
+		if !required[topic] {
+			caughtUp = false
+		}
+	}
+
+	report.Ready = report.Live && health.Connection == "CONNECTED" && caughtUp
+
+	return report
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := h.Report()
+
+	healthy := report.Ready
+	if strings.HasSuffix(r.URL.Path, "/live") {
+		healthy = report.Live
+	}
+
+	status := http.StatusOK
+	if !healthy {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(report)
+}
+
+type Options struct {
+	// Topics is optional. If it's set, the broker is ready once a subscription of each
+	// topic has caught up, otherwise once every subscription has caught up
+	Topics []string
+}
+
+// New creates a Handler which reports the health of given broker
+func New(reporter Reporter, opt *Options) *Handler {
+	handler := &Handler{
+		reporter: reporter,
+		topics:   make(map[string]struct{}),
+	}
+
+	if opt != nil {
+		for _, topic := range opt.Topics {
+			handler.topics[topic] = struct{}{}
+		}
+	}
+
+	return handler
+}
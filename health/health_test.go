@@ -0,0 +1,169 @@
+package health_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nulloop/chu/v2"
+	"github.com/nulloop/chu/v2/broker"
+	"github.com/nulloop/chu/v2/health"
+)
+
+type sub struct {
+	topic  string
+	handle func(event chu.ReceivedEvent) bool
+}
+
+func (s *sub) Topic() string                            { return s.topic }
+func (s *sub) Durable() bool                            { return false }
+func (s *sub) Group() string                            { return "" }
+func (s *sub) HandleEvent(event chu.ReceivedEvent) bool { return s.handle(event) }
+
+func get(t *testing.T, handler http.Handler, path string) (int, *health.Report) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+
+	report := &health.Report{}
+
+	err := json.NewDecoder(recorder.Body).Decode(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return recorder.Code, report
+}
+
+func publish(t *testing.T, b chu.Broker, topic string) {
+	event, err := b.CreateEvent(chu.EventOptions{
+		Topic: topic,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Publish(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID:      "foo",
+		WarmUpTimeout: 1 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, memory, "a.b.c")
+
+	release := make(chan struct{})
+
+	_, err = memory.Subscribe(&sub{
+		topic: "a.b.c",
+		handle: func(event chu.ReceivedEvent) bool {
+			<-release
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := health.New(memory, nil)
+
+	code, report := get(t, handler, "/health/live")
+	if code != http.StatusOK || !report.Live {
+		t.Fatalf("expected broker to be live but got %d %+v", code, report)
+	}
+
+	code, report = get(t, handler, "/health/ready")
+	if code != http.StatusServiceUnavailable || report.Ready || !report.WarmingUp {
+		t.Fatalf("expected broker not to be ready but got %d %+v", code, report)
+	}
+
+	close(release)
+	memory.Wait()
+
+	code, report = get(t, handler, "/health/ready")
+	if code != http.StatusOK || !report.Ready {
+		t.Fatalf("expected broker to be ready but got %d %+v", code, report)
+	}
+
+	if len(report.Subscriptions) != 1 || report.Subscriptions[0].Replayed != 1 || report.LastMessageAt == nil {
+		t.Fatalf("unexpected subscriptions %+v", report.Subscriptions)
+	}
+
+	memory.Close()
+
+	code, report = get(t, handler, "/health/live")
+	if code != http.StatusServiceUnavailable || report.Live || report.Connection != "CLOSED" {
+		t.Fatalf("expected closed broker not to be live but got %d %+v", code, report)
+	}
+}
+
+func TestHandlerTopics(t *testing.T) {
+	memory, err := broker.NewMemory(&broker.MemoryOptions{
+		ClientID:      "foo",
+		WarmUpTimeout: 1 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer memory.Close()
+
+	publish(t, memory, "slow")
+
+	release := make(chan struct{})
+	defer close(release)
+
+	for _, topic := range []string{"fast", "slow"} {
+		_, err = memory.Subscribe(&sub{
+			topic: topic,
+			handle: func(event chu.ReceivedEvent) bool {
+				<-release
+				return true
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	code, _ := get(t, health.New(memory, nil), "/ready")
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("expected broker not to be ready while slow is replaying but got %d", code)
+	}
+
+	code, _ = get(t, health.New(memory, &health.Options{Topics: []string{"fast"}}), "/ready")
+	if code != http.StatusOK {
+		t.Fatalf("expected broker to be ready once fast has caught up but got %d", code)
+	}
+}
+
+type reporter broker.Health
+
+func (r *reporter) Health() broker.Health { return broker.Health(*r) }
+
+func TestHandlerReconnecting(t *testing.T) {
+	handler := health.New(&reporter{
+		Connection: "RECONNECTING",
+		Session:    true,
+	}, nil)
+
+	// reconnecting brokers are not restarted, but don't take traffic
+	code, report := get(t, handler, "/health/live")
+	if code != http.StatusOK || !report.Live {
+		t.Fatalf("expected reconnecting broker to be live but got %d %+v", code, report)
+	}
+
+	code, report = get(t, handler, "/health/ready")
+	if code != http.StatusServiceUnavailable || report.Ready {
+		t.Fatalf("expected reconnecting broker not to be ready but got %d %+v", code, report)
+	}
+}
@@ -0,0 +1,115 @@
+// Package idgen contains the built-in implementations of chu.IDGenerator
+package idgen
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/nulloop/chu/v2"
+)
+
+var _ chu.IDGenerator = XID{}
+var _ chu.IDGenerator = UUIDv4{}
+var _ chu.IDGenerator = UUIDv7{}
+var _ chu.IDGenerator = ULID{}
+
+// random fills b with random bytes. Failing to read from crypto/rand
+// means the system is unusable, so it panics the same way as xid does
+func random(b []byte) {
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+}
+
+// XID generates 20 characters, sortable ids. See github.com/rs/xid
+type XID struct{}
+
+func (XID) NewID() string {
+	return xid.New().String()
+}
+
+// UUIDv4 generates random uuids as described in RFC 4122
+type UUIDv4 struct{}
+
+func (UUIDv4) NewID() string {
+	var uuid [16]byte
+	random(uuid[:])
+
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+
+	return formatUUID(uuid)
+}
+
+// UUIDv7 generates time ordered uuids. The first 48 bits are
+// unix time in milliseconds and the rest are random
+type UUIDv7 struct{}
+
+func (UUIDv7) NewID() string {
+	var uuid [16]byte
+	random(uuid[6:])
+
+	putMillis(uuid[:6], time.Now())
+
+	uuid[6] = (uuid[6] & 0x0f) | 0x70
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+
+	return formatUUID(uuid)
+}
+
+func formatUUID(uuid [16]byte) string {
+	var buf [36]byte
+
+	hex.Encode(buf[0:8], uuid[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], uuid[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], uuid[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], uuid[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], uuid[10:])
+
+	return string(buf[:])
+}
+
+// putMillis writes unix time of t in milliseconds as 48 bits big endian
+func putMillis(b []byte, t time.Time) {
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(t.UnixNano()/int64(time.Millisecond)))
+	copy(b, ms[2:])
+}
+
+// crockford is the base32 alphabet used by ULID
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULID generates 26 characters, lexicographically sortable ids.
+// See github.com/ulid/spec
+type ULID struct{}
+
+func (ULID) NewID() string {
+	var ulid [16]byte
+	random(ulid[6:])
+
+	putMillis(ulid[:6], time.Now())
+
+	// 128 bits are encoded into 26 characters of 5 bits, the
+	// first character only holds the 3 most significant bits
+	var buf [26]byte
+
+	hi := binary.BigEndian.Uint64(ulid[:8])
+	lo := binary.BigEndian.Uint64(ulid[8:])
+
+	for i := 25; i >= 0; i-- {
+		buf[i] = crockford[lo&0x1f]
+		lo = (lo >> 5) | (hi << 59)
+		hi >>= 5
+	}
+
+	return string(buf[:])
+}
@@ -0,0 +1,72 @@
+package idgen_test
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/nulloop/chu/v2"
+	"github.com/nulloop/chu/v2/idgen"
+)
+
+func TestGenerators(t *testing.T) {
+	testCases := []struct {
+		name      string
+		generator chu.IDGenerator
+		format    *regexp.Regexp
+		sortable  bool
+	}{
+		{
+			name:      "xid",
+			generator: idgen.XID{},
+			format:    regexp.MustCompile(`^[0-9a-v]{20}$`),
+		},
+		{
+			name:      "uuidv4",
+			generator: idgen.UUIDv4{},
+			format:    regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+		},
+		{
+			name:      "uuidv7",
+			generator: idgen.UUIDv7{},
+			format:    regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+			sortable:  true,
+		},
+		{
+			name:      "ulid",
+			generator: idgen.ULID{},
+			format:    regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`),
+			sortable:  true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		seen := make(map[string]bool)
+
+		for i := 0; i < 1000; i++ {
+			id := testCase.generator.NewID()
+
+			if !testCase.format.MatchString(id) {
+				t.Fatalf("%s: unexpected format %s", testCase.name, id)
+			}
+
+			if seen[id] {
+				t.Fatalf("%s: duplicate id %s", testCase.name, id)
+			}
+
+			seen[id] = true
+		}
+
+		if !testCase.sortable {
+			continue
+		}
+
+		first := testCase.generator.NewID()
+		time.Sleep(2 * time.Millisecond)
+		second := testCase.generator.NewID()
+
+		if first >= second {
+			t.Fatalf("%s: expected %s to be sorted before %s", testCase.name, first, second)
+		}
+	}
+}
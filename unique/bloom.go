@@ -0,0 +1,261 @@
+package unique
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nulloop/chu/v2"
+)
+
+var _ chu.Idempotency = &Bloom{}
+
+// filter is a single bloom filter of m bits and k hash functions
+type filter struct {
+	bits  []uint64
+	m     uint64
+	k     uint64
+	set   uint64 // number of bits which are set
+	added int    // number of ids which are added
+}
+
+func newFilter(m, k uint64) *filter {
+	return &filter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// hashes returns two fnv-1a hashes of id which are
+// combined to derive k hashes, see Kirsch and Mitzenmacher
+func hashes(id string) (uint64, uint64) {
+	h1 := uint64(14695981039346656037)
+	for i := 0; i < len(id); i++ {
+		h1 ^= uint64(id[i])
+		h1 *= 1099511628211
+	}
+
+	h2 := h1
+	h2 ^= 0xff
+	h2 *= 1099511628211
+
+	// h2 must be odd, otherwise derived hashes might repeat
+	return h1, h2 | 1
+}
+
+func (f *filter) contains(h1, h2 uint64) bool {
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *filter) add(h1, h2 uint64) {
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		mask := uint64(1) << (bit % 64)
+
+		if f.bits[bit/64]&mask == 0 {
+			f.bits[bit/64] |= mask
+			f.set++
+		}
+	}
+
+	f.added++
+}
+
+func (f *filter) fill() float64 {
+	return float64(f.set) / float64(f.m)
+}
+
+// BloomStats reports the state of the current generation of Bloom
+type BloomStats struct {
+	// Fill is the ratio of set bits. Once it passes 0.5 the
+	// false positive rate climbs quickly
+	Fill float64
+	// Estimated is the estimated number of ids in the current generation
+	Estimated int
+	// FalsePositiveRate is the estimated rate of the current generation at its fill
+	FalsePositiveRate float64
+	// Rotations is the number of times generations have been rotated
+	Rotations uint64
+}
+
+// Bloom is a probabilistic replacement of Idempotency for high volume topics. It
+// uses a fixed amount of memory, but may report a unique id as a duplicate at the
+// configured false positive rate. It never reports a duplicate as unique while the
+// id is remembered.
+//
+// Bloom keeps two generations of filters. Ids are added to the current one and are
+// looked up in both. Once the current generation is full or older than Rotation,
+// the previous one is dropped and the current one takes its place, so an id is
+// remembered for at least one generation.
+//
+// Reserved ids are kept exactly until they are committed or released, so only
+// processed ids are added to the filters.
+type Bloom struct {
+	mtx       sync.Mutex
+	reserved  map[string]struct{}
+	current   *filter
+	previous  *filter
+	m         uint64
+	k         uint64
+	capacity  int
+	rotation  time.Duration
+	rotatedAt time.Time
+	rotations uint64
+}
+
+func (b *Bloom) rotate(now time.Time) {
+	b.previous = b.current
+	b.current = newFilter(b.m, b.k)
+	b.rotatedAt = now
+	b.rotations++
+}
+
+// expire rotates generations once the current one is full or too old
+func (b *Bloom) expire(now time.Time) {
+	if b.current.added >= b.capacity || (b.rotation > 0 && now.Sub(b.rotatedAt) >= b.rotation) {
+		b.rotate(now)
+	}
+}
+
+func (b *Bloom) contains(h1, h2 uint64) bool {
+	return b.current.contains(h1, h2) || (b.previous != nil && b.previous.contains(h1, h2))
+}
+
+// Reserve returns false if given id has been probably committed, or if
+// it's reserved and has been neither committed nor released yet
+func (b *Bloom) Reserve(given string) bool {
+	h1, h2 := hashes(given)
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.expire(time.Now())
+
+	if _, ok := b.reserved[given]; ok || b.contains(h1, h2) {
+		return false
+	}
+
+	b.reserved[given] = struct{}{}
+	return true
+}
+
+// Commit records the reserved id as processed
+func (b *Bloom) Commit(given string) {
+	h1, h2 := hashes(given)
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	delete(b.reserved, given)
+
+	b.expire(time.Now())
+	b.current.add(h1, h2)
+}
+
+// Committed returns true if given id has been probably committed
+func (b *Bloom) Committed(given string) bool {
+	h1, h2 := hashes(given)
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.contains(h1, h2)
+}
+
+// Release gives up the reservation of given id, so it can be reserved again
+func (b *Bloom) Release(given string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	delete(b.reserved, given)
+}
+
+// IsUnique records given id and returns false if it has been probably recorded.
+// It matches NatsOptions.UniqueMsgChecker
+//
+// Deprecated: use Bloom as NatsOptions.Idempotency, so ids of failed events
+// are not recorded
+func (b *Bloom) IsUnique(given string) bool {
+	h1, h2 := hashes(given)
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.expire(time.Now())
+
+	if b.contains(h1, h2) {
+		return false
+	}
+
+	b.current.add(h1, h2)
+	return true
+}
+
+// Stats returns a snapshot of the current generation
+func (b *Bloom) Stats() BloomStats {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	fill := b.current.fill()
+	m, k := float64(b.m), float64(b.k)
+
+	return BloomStats{
+		Fill:              fill,
+		Estimated:         int(math.Round(-m / k * math.Log(1-math.Min(fill, 1-1/m)))),
+		FalsePositiveRate: math.Pow(fill, k),
+		Rotations:         b.rotations,
+	}
+}
+
+// BloomOptions configures Bloom created by NewBloom
+type BloomOptions struct {
+	// Capacity is the number of ids each generation holds
+	// before it's rotated at the configured false positive rate
+	Capacity int
+	// FalsePositiveRate defaults to 0.01. It's the rate of lookups in both
+	// generations, so each generation is sized for half of it
+	FalsePositiveRate float64
+	// Rotation is optional. Generations older than Rotation are rotated
+	// even if they are not full, so ids are remembered for at least
+	// Rotation and at most twice Rotation
+	Rotation time.Duration
+}
+
+// NewBloom sizes the filters for opt.Capacity ids at opt.FalsePositiveRate
+func NewBloom(opt *BloomOptions) *Bloom {
+	capacity := opt.Capacity
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	rate := opt.FalsePositiveRate
+	if rate <= 0 || rate >= 1 {
+		rate = 0.01
+	}
+
+	// ids are looked up in two generations, so false positives of both add up
+	rate /= 2
+
+	// optimal number of bits and hash functions, see
+	// https://en.wikipedia.org/wiki/Bloom_filter#Optimal_number_of_hash_functions
+	m := math.Ceil(-float64(capacity) * math.Log(rate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(capacity)*math.Ln2))
+
+	return &Bloom{
+		reserved:  make(map[string]struct{}),
+		current:   newFilter(uint64(m), uint64(k)),
+		m:         uint64(m),
+		k:         uint64(k),
+		capacity:  capacity,
+		rotation:  opt.Rotation,
+		rotatedAt: time.Now(),
+	}
+}
@@ -0,0 +1,118 @@
+package unique_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nulloop/chu/v2/unique"
+)
+
+func TestBloom(t *testing.T) {
+	const capacity = 10000
+
+	bloom := unique.NewBloom(&unique.BloomOptions{
+		Capacity:          capacity,
+		FalsePositiveRate: 0.01,
+	})
+
+	falsePositives := 0
+	for i := 0; i < capacity; i++ {
+		if !bloom.IsUnique(fmt.Sprint(i)) {
+			falsePositives++
+		}
+	}
+
+	for i := 0; i < capacity; i++ {
+		if bloom.IsUnique(fmt.Sprint(i)) {
+			t.Fatalf("expected %d not to be unique", i)
+		}
+	}
+
+	if rate := float64(falsePositives) / capacity; rate > 0.02 {
+		t.Fatalf("expected false positive rate to be around 0.01 but got %f", rate)
+	}
+
+	stats := bloom.Stats()
+	if stats.Fill < 0.4 || stats.Fill > 0.6 {
+		t.Fatalf("expected a full filter to be half filled but got %f", stats.Fill)
+	}
+
+	if stats.Estimated < capacity*9/10 || stats.Estimated > capacity*11/10 {
+		t.Fatalf("expected around %d ids but got %d", capacity, stats.Estimated)
+	}
+}
+
+func TestBloomIdempotency(t *testing.T) {
+	bloom := unique.NewBloom(&unique.BloomOptions{
+		Capacity: 100,
+	})
+
+	if !bloom.Reserve("1") {
+		t.Fatal("expected 1 to be reserved")
+	}
+
+	if bloom.Reserve("1") {
+		t.Fatal("expected 1 not to be reserved while it's in progress")
+	}
+
+	bloom.Release("1")
+
+	if !bloom.Reserve("1") {
+		t.Fatal("expected released 1 to be reserved again")
+	}
+
+	bloom.Commit("1")
+
+	if bloom.Reserve("1") {
+		t.Fatal("expected committed 1 not to be reserved")
+	}
+
+	if stats := bloom.Stats(); stats.Estimated != 1 {
+		t.Fatalf("expected only committed ids to be added but got %d", stats.Estimated)
+	}
+}
+
+func TestBloomRotation(t *testing.T) {
+	bloom := unique.NewBloom(&unique.BloomOptions{
+		Capacity: 100,
+		Rotation: 50 * time.Millisecond,
+	})
+
+	if !bloom.IsUnique("1") {
+		t.Fatal("expected 1 to be unique")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if bloom.IsUnique("1") {
+		t.Fatal("expected 1 to be remembered by the previous generation")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if !bloom.IsUnique("1") {
+		t.Fatal("expected 1 to be forgotten after two rotations")
+	}
+
+	if rotations := bloom.Stats().Rotations; rotations != 2 {
+		t.Fatalf("expected 2 rotations but got %d", rotations)
+	}
+}
+
+func BenchmarkBloom(b *testing.B) {
+	bloom := unique.NewBloom(&unique.BloomOptions{
+		Capacity: 1 << 22,
+	})
+
+	ids := make([]string, 1<<20)
+	for i := range ids {
+		ids[i] = fmt.Sprint(i)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bloom.IsUnique(ids[i%len(ids)])
+	}
+}
@@ -0,0 +1,325 @@
+package unique
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/nulloop/chu/v2"
+)
+
+var _ chu.Idempotency = &Bolt{}
+
+var (
+	// idsBucket maps each id to the time it was committed at
+	idsBucket = []byte("ids")
+	// timesBucket maps the time an id was committed at followed by the id
+	// itself to nothing, so compaction walks ids from the oldest one
+	timesBucket = []byte("times")
+)
+
+// SyncPolicy tells Bolt when to flush committed ids to disk
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs on every commit. An id which is committed survives
+	// even a power failure
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs every BoltOptions.SyncInterval. Ids committed since the
+	// last fsync survive a process crash but may be lost on power failure
+	SyncInterval
+	// SyncNever leaves flushing to the operating system
+	SyncNever
+)
+
+func encodeTime(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return b
+}
+
+func decodeTime(b []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+}
+
+// Bolt is an Idempotency which stores committed ids in a bbolt file, so
+// events are still deduplicated after the process restarts. Reservations are
+// kept in memory as they belong to handlers of the running process.
+type Bolt struct {
+	db       *bolt.DB
+	ttl      time.Duration
+	onError  func(error)
+	mtx      sync.Mutex
+	reserved map[string]struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func (b *Bolt) expired(at time.Time, now time.Time) bool {
+	return b.ttl > 0 && now.Sub(at) >= b.ttl
+}
+
+func (b *Bolt) lookup(tx *bolt.Tx, given string, now time.Time) bool {
+	value := tx.Bucket(idsBucket).Get([]byte(given))
+	if value == nil {
+		return false
+	}
+
+	return !b.expired(decodeTime(value), now)
+}
+
+func (b *Bolt) add(tx *bolt.Tx, given string, now time.Time) error {
+	id := []byte(given)
+	at := encodeTime(now)
+
+	err := tx.Bucket(idsBucket).Put(id, at)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(timesBucket).Put(append(at, id...), nil)
+}
+
+func (b *Bolt) error(err error) {
+	if err != nil && b.onError != nil {
+		b.onError(err)
+	}
+}
+
+// IsUnique records given id and returns false if it has been already recorded
+func (b *Bolt) IsUnique(given string) bool {
+	unique := true
+	now := time.Now()
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if b.lookup(tx, given, now) {
+			unique = false
+			return nil
+		}
+
+		return b.add(tx, given, now)
+	})
+	b.error(err)
+
+	return unique
+}
+
+// Reserve returns false if given id has been already committed or
+// it's reserved and has been neither committed nor released yet. If the
+// file can't be read, the id is reserved so the event is not lost
+func (b *Bolt) Reserve(given string) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if _, ok := b.reserved[given]; ok {
+		return false
+	}
+
+	found := false
+	now := time.Now()
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		found = b.lookup(tx, given, now)
+		return nil
+	})
+	b.error(err)
+
+	if found {
+		return false
+	}
+
+	b.reserved[given] = struct{}{}
+	return true
+}
+
+// Committed returns true if given id has been committed and has not expired
+func (b *Bolt) Committed(given string) bool {
+	found := false
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		found = b.lookup(tx, given, time.Now())
+		return nil
+	})
+	b.error(err)
+
+	return found
+}
+
+// Commit records the reserved id as processed
+func (b *Bolt) Commit(given string) {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return b.add(tx, given, time.Now())
+	})
+	b.error(err)
+
+	b.Release(given)
+}
+
+// Release gives up the reservation of given id, so it can be reserved again
+func (b *Bolt) Release(given string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	delete(b.reserved, given)
+}
+
+// Compact removes ids which are older than TTL. It's called
+// every BoltOptions.CompactInterval if TTL is set
+func (b *Bolt) Compact() error {
+	if b.ttl <= 0 {
+		return nil
+	}
+
+	deadline := encodeTime(time.Now().Add(-b.ttl))
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		ids := tx.Bucket(idsBucket)
+		times := tx.Bucket(timesBucket)
+
+		// deleting while iterating a cursor skips keys, so expired keys are collected first
+		var expired [][]byte
+
+		cursor := times.Cursor()
+		for key, _ := cursor.First(); key != nil && bytes.Compare(key[:8], deadline) <= 0; key, _ = cursor.Next() {
+			expired = append(expired, append([]byte(nil), key...))
+		}
+
+		for _, key := range expired {
+			at, id := key[:8], key[8:]
+
+			// the id might have been committed again after it expired
+			if bytes.Equal(ids.Get(id), at) {
+				err := ids.Delete(id)
+				if err != nil {
+					return err
+				}
+			}
+
+			err := times.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Len returns the number of stored ids, including expired ones which are not compacted yet
+func (b *Bolt) Len() int {
+	count := 0
+
+	b.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(idsBucket).Stats().KeyN
+		return nil
+	})
+
+	return count
+}
+
+func (b *Bolt) every(interval time.Duration, fn func() error) {
+	b.wg.Add(1)
+
+	go func() {
+		defer b.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				b.error(fn())
+			case <-b.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops compaction, flushes committed ids and closes the file
+func (b *Bolt) Close() error {
+	close(b.done)
+	b.wg.Wait()
+
+	err := b.db.Sync()
+	if err != nil {
+		b.db.Close()
+		return err
+	}
+
+	return b.db.Close()
+}
+
+// BoltOptions configures Bolt created by NewBolt
+type BoltOptions struct {
+	// Path of the file which is created if it doesn't exist
+	Path string
+	// TTL is optional. Ids older than TTL are forgotten
+	TTL time.Duration
+	// CompactInterval defaults to TTL. Compaction is disabled if TTL is not set
+	CompactInterval time.Duration
+	// Sync defaults to SyncAlways
+	Sync SyncPolicy
+	// SyncInterval is used by SyncInterval policy and defaults to one second
+	SyncInterval time.Duration
+	// OnError is optional and is called with errors of reading or writing the file.
+	// Reserve treats ids which can't be read as not processed
+	OnError func(err error)
+}
+
+// NewBolt opens or creates the file at opt.Path
+func NewBolt(opt *BoltOptions) (*Bolt, error) {
+	db, err := bolt.Open(opt.Path, 0600, &bolt.Options{
+		Timeout: 1 * time.Second,
+		NoSync:  opt.Sync != SyncAlways,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(idsBucket)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(timesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	b := &Bolt{
+		db:       db,
+		ttl:      opt.TTL,
+		onError:  opt.OnError,
+		reserved: make(map[string]struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if b.ttl > 0 {
+		interval := opt.CompactInterval
+		if interval <= 0 {
+			interval = b.ttl
+		}
+
+		b.every(interval, b.Compact)
+	}
+
+	if opt.Sync == SyncInterval {
+		interval := opt.SyncInterval
+		if interval <= 0 {
+			interval = 1 * time.Second
+		}
+
+		b.every(interval, db.Sync)
+	}
+
+	return b, nil
+}
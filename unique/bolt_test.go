@@ -0,0 +1,100 @@
+package unique_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nulloop/chu/v2/unique"
+)
+
+func tempBoltPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "chu-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, "idempotency.db")
+}
+
+func TestBoltRestart(t *testing.T) {
+	path := tempBoltPath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	idempotency, err := unique.NewBolt(&unique.BoltOptions{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !idempotency.Reserve("1") {
+		t.Fatal("expected 1 to be reserved")
+	}
+
+	if idempotency.Reserve("1") {
+		t.Fatal("expected 1 not to be reserved while it's in progress")
+	}
+
+	idempotency.Commit("1")
+
+	if !idempotency.Reserve("2") {
+		t.Fatal("expected 2 to be reserved")
+	}
+
+	err = idempotency.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idempotency, err = unique.NewBolt(&unique.BoltOptions{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer idempotency.Close()
+
+	if idempotency.Reserve("1") {
+		t.Fatal("expected committed 1 not to be reserved after restart")
+	}
+
+	if !idempotency.Reserve("2") {
+		t.Fatal("expected uncommitted 2 to be reserved after restart")
+	}
+}
+
+func TestBoltCompaction(t *testing.T) {
+	path := tempBoltPath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	idempotency, err := unique.NewBolt(&unique.BoltOptions{
+		Path:            path,
+		TTL:             50 * time.Millisecond,
+		CompactInterval: 20 * time.Millisecond,
+		Sync:            unique.SyncInterval,
+		SyncInterval:    10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer idempotency.Close()
+
+	if !idempotency.IsUnique("1") {
+		t.Fatal("expected 1 to be unique")
+	}
+
+	if idempotency.IsUnique("1") {
+		t.Fatal("expected 1 not to be unique before it expires")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if n := idempotency.Len(); n != 0 {
+		t.Fatalf("expected expired ids to be compacted but got %d", n)
+	}
+
+	if !idempotency.IsUnique("1") {
+		t.Fatal("expected 1 to be unique after it expired")
+	}
+}
@@ -1,51 +1,253 @@
 package unique
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+	"time"
 
-type Idempotency struct {
-	idx    int
-	values []string
-	mtx    sync.Mutex
+	"github.com/nulloop/chu/v2"
+)
+
+var _ chu.Idempotency = &Idempotency{}
+
+// slot is an entry of shard's ring
+type slot struct {
+	id string
+	at time.Time
 }
 
-func (i *Idempotency) lookup(given string) int {
-	i.mtx.Lock()
-	defer i.mtx.Unlock()
+// shard remembers ids in a ring, so once it's full the oldest id is evicted.
+// index maps each id to its slot in ring which makes every operation O(1)
+type shard struct {
+	mtx      sync.Mutex
+	ring     []slot
+	next     int
+	index    map[string]int
+	reserved map[string]struct{}
+}
 
-	for idx, val := range i.values {
-		if val == given {
-			return idx
-		}
+// lookup returns true if given id is remembered and has not expired
+func (s *shard) lookup(i *Idempotency, given string, now time.Time) bool {
+	idx, ok := s.index[given]
+	if !ok {
+		return false
 	}
 
-	return -1
+	if i.ttl > 0 && now.Sub(s.ring[idx].at) >= i.ttl {
+		delete(s.index, given)
+		atomic.AddUint64(&i.expirations, 1)
+		return false
+	}
+
+	return true
 }
 
-func (i *Idempotency) add(given string) {
-	i.mtx.Lock()
-	defer i.mtx.Unlock()
+func (s *shard) add(i *Idempotency, given string, now time.Time) {
+	if _, ok := s.index[given]; ok {
+		return
+	}
 
-	if i.idx == (len(i.values) - 1) {
-		i.idx = 0
+	evicted := s.ring[s.next]
+	if idx, ok := s.index[evicted.id]; ok && idx == s.next {
+		delete(s.index, evicted.id)
+		atomic.AddUint64(&i.evictions, 1)
 	}
 
-	i.values[i.idx] = given
-	i.idx++
+	s.ring[s.next] = slot{id: given, at: now}
+	s.index[given] = s.next
+	s.next = (s.next + 1) % len(s.ring)
+}
+
+// Stats reports how Idempotency has been used so far. It can be used to size it
+type Stats struct {
+	Hits        uint64 // duplicate ids
+	Misses      uint64 // unique ids
+	Evictions   uint64 // ids which are forgotten to make room for new ones
+	Expirations uint64 // ids which are forgotten because they are older than TTL
+	Len         int    // number of remembered ids, including expired ones which are not evicted yet
 }
 
+// Idempotency remembers the ids of processed events. It keeps up to Size ids
+// in shards which are locked separately, so concurrent subscribers don't wait on
+// each other.
+type Idempotency struct {
+	shards      []*shard
+	ttl         time.Duration
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	expirations uint64
+}
+
+// fnv32a hashes id to pick its shard
+func fnv32a(id string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(id); i++ {
+		hash ^= uint32(id[i])
+		hash *= 16777619
+	}
+
+	return hash
+}
+
+func (i *Idempotency) shard(given string) *shard {
+	return i.shards[fnv32a(given)%uint32(len(i.shards))]
+}
+
+func (i *Idempotency) count(found bool) {
+	if found {
+		atomic.AddUint64(&i.hits, 1)
+	} else {
+		atomic.AddUint64(&i.misses, 1)
+	}
+}
+
+// IsUnique records given id and returns false if it has been already recorded
 func (i *Idempotency) IsUnique(given string) bool {
-	if i.lookup(given) != -1 {
+	s := i.shard(given)
+	now := time.Now()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	found := s.lookup(i, given, now)
+	i.count(found)
+
+	if found {
+		return false
+	}
+
+	s.add(i, given, now)
+	return true
+}
+
+// Reserve returns false if given id has been already committed or
+// it's reserved and has been neither committed nor released yet
+func (i *Idempotency) Reserve(given string) bool {
+	s := i.shard(given)
+	now := time.Now()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, reserved := s.reserved[given]
+	found := reserved || s.lookup(i, given, now)
+	i.count(found)
+
+	if found {
 		return false
 	}
 
-	i.add(given)
+	s.reserved[given] = struct{}{}
 	return true
 }
 
-// New creates an Idempotency object
-// NOTE: Use the optimal size for your Idempotency. very small
+// Committed returns true if given id has been committed and is still remembered
+func (i *Idempotency) Committed(given string) bool {
+	s := i.shard(given)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.lookup(i, given, time.Now())
+}
+
+// Commit records the reserved id as processed
+func (i *Idempotency) Commit(given string) {
+	s := i.shard(given)
+	now := time.Now()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.reserved, given)
+	s.add(i, given, now)
+}
+
+// Release gives up the reservation of given id, so it can be reserved again
+func (i *Idempotency) Release(given string) {
+	s := i.shard(given)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.reserved, given)
+}
+
+// Stats returns a snapshot of counters and the number of remembered ids
+func (i *Idempotency) Stats() Stats {
+	stats := Stats{
+		Hits:        atomic.LoadUint64(&i.hits),
+		Misses:      atomic.LoadUint64(&i.misses),
+		Evictions:   atomic.LoadUint64(&i.evictions),
+		Expirations: atomic.LoadUint64(&i.expirations),
+	}
+
+	for _, s := range i.shards {
+		s.mtx.Lock()
+		stats.Len += len(s.index)
+		s.mtx.Unlock()
+	}
+
+	return stats
+}
+
+// Options configures Idempotency created by NewWithOptions
+type Options struct {
+	// Size is the maximum number of ids which are remembered
+	Size int
+	// TTL is optional. Ids older than TTL are forgotten
+	TTL time.Duration
+	// Shards is optional and defaults to one shard per 4096 ids, up to 32 shards.
+	// Each shard evicts its own oldest id, so with more than one shard the
+	// evicted id is not necessarily the oldest one overall.
+	Shards int
+}
+
+// New creates an Idempotency object which remembers up to size ids
 func New(size int) *Idempotency {
-	return &Idempotency{
-		values: make([]string, size),
+	return NewWithOptions(&Options{
+		Size: size,
+	})
+}
+
+// NewWithOptions creates an Idempotency object
+func NewWithOptions(opt *Options) *Idempotency {
+	size := opt.Size
+	if size < 1 {
+		size = 1
+	}
+
+	shards := opt.Shards
+	if shards < 1 {
+		shards = size / 4096
+		if shards > 32 {
+			shards = 32
+		}
+	}
+
+	if shards < 1 {
+		shards = 1
 	}
+
+	if shards > size {
+		shards = size
+	}
+
+	idempotency := &Idempotency{
+		shards: make([]*shard, shards),
+		ttl:    opt.TTL,
+	}
+
+	perShard := (size + shards - 1) / shards
+
+	for i := range idempotency.shards {
+		idempotency.shards[i] = &shard{
+			ring:     make([]slot, perShard),
+			index:    make(map[string]int, perShard),
+			reserved: make(map[string]struct{}),
+		}
+	}
+
+	return idempotency
 }
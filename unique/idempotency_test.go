@@ -1,7 +1,9 @@
 package unique_test
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/nulloop/chu/v2/unique"
 )
@@ -23,7 +25,13 @@ func TestIdempotency(t *testing.T) {
 			size:         4,
 			initialItems: []string{},
 			tests:        []string{"1", "2", "3", "4", "4", "1"},
-			expected:     []bool{true, true, true, true, false, true},
+			expected:     []bool{true, true, true, true, false, false},
+		},
+		{
+			size:         4,
+			initialItems: []string{"1", "2", "3", "4"},
+			tests:        []string{"5", "2", "1", "5"},
+			expected:     []bool{true, false, true, false},
 		},
 		{
 			size:         4,
@@ -47,3 +55,142 @@ func TestIdempotency(t *testing.T) {
 		}
 	}
 }
+
+func TestIdempotencyReservation(t *testing.T) {
+	idempotency := unique.New(4)
+
+	if !idempotency.Reserve("1") {
+		t.Fatal("expected 1 to be reserved")
+	}
+
+	if idempotency.Reserve("1") {
+		t.Fatal("expected 1 not to be reserved while it's in progress")
+	}
+
+	if idempotency.Committed("1") {
+		t.Fatal("expected 1 not to be committed while it's in progress")
+	}
+
+	idempotency.Release("1")
+
+	if !idempotency.Reserve("1") {
+		t.Fatal("expected 1 to be reserved again after being released")
+	}
+
+	idempotency.Commit("1")
+
+	if idempotency.Reserve("1") {
+		t.Fatal("expected 1 not to be reserved after being committed")
+	}
+
+	if !idempotency.Committed("1") {
+		t.Fatal("expected 1 to be committed")
+	}
+
+	if idempotency.IsUnique("1") {
+		t.Fatal("expected committed 1 not to be unique")
+	}
+}
+
+func TestIdempotencyTTL(t *testing.T) {
+	idempotency := unique.NewWithOptions(&unique.Options{
+		Size: 4,
+		TTL:  50 * time.Millisecond,
+	})
+
+	if !idempotency.IsUnique("1") {
+		t.Fatal("expected 1 to be unique")
+	}
+
+	if idempotency.IsUnique("1") {
+		t.Fatal("expected 1 not to be unique before it expires")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if !idempotency.IsUnique("1") {
+		t.Fatal("expected 1 to be unique after it expired")
+	}
+
+	if stats := idempotency.Stats(); stats.Expirations != 1 {
+		t.Fatalf("expected 1 expiration but got %d", stats.Expirations)
+	}
+}
+
+func TestIdempotencyStats(t *testing.T) {
+	idempotency := unique.New(2)
+
+	for _, item := range []string{"1", "2", "1", "3", "1"} {
+		idempotency.IsUnique(item)
+	}
+
+	expected := unique.Stats{
+		Hits:      1,
+		Misses:    4,
+		Evictions: 2,
+		Len:       2,
+	}
+
+	if stats := idempotency.Stats(); stats != expected {
+		t.Fatalf("expected %+v but got %+v", expected, stats)
+	}
+}
+
+func TestIdempotencyShards(t *testing.T) {
+	idempotency := unique.NewWithOptions(&unique.Options{
+		Size:   1 << 16,
+		Shards: 8,
+	})
+
+	for i := 0; i < 1<<14; i++ {
+		if !idempotency.IsUnique(fmt.Sprint(i)) {
+			t.Fatalf("expected %d to be unique", i)
+		}
+	}
+
+	for i := 0; i < 1<<14; i++ {
+		if idempotency.IsUnique(fmt.Sprint(i)) {
+			t.Fatalf("expected %d not to be unique", i)
+		}
+	}
+}
+
+func benchmarkIsUnique(b *testing.B, size int) {
+	idempotency := unique.New(size)
+
+	ids := make([]string, size)
+	for i := range ids {
+		ids[i] = fmt.Sprint(i)
+		idempotency.IsUnique(ids[i])
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		idempotency.IsUnique(ids[i%size])
+	}
+}
+
+func BenchmarkIsUnique1M(b *testing.B) { benchmarkIsUnique(b, 1<<20) }
+func BenchmarkIsUnique4M(b *testing.B) { benchmarkIsUnique(b, 1<<22) }
+
+func BenchmarkIsUniqueParallel(b *testing.B) {
+	const size = 1 << 20
+
+	idempotency := unique.New(size)
+
+	ids := make([]string, size)
+	for i := range ids {
+		ids[i] = fmt.Sprint(i)
+	}
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			idempotency.IsUnique(ids[i%size])
+			i++
+		}
+	})
+}